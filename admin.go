@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// adminToken enables /admin/ endpoints when set. Requests must carry it as
+// "Authorization: Bearer <token>".
+var adminToken string
+
+func checkAdminAuth(resp http.ResponseWriter, req *http.Request) bool {
+	expected := []byte("Bearer " + adminToken)
+	if subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), expected) == 1 {
+		return true
+	}
+	resp.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+	http.Error(resp, "unauthorized", http.StatusUnauthorized)
+	return false
+}
+
+func handleReloadSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		if frozen.Load() {
+			log.Printf("Ignoring SIGHUP, the layer registry is frozen")
+			continue
+		}
+		log.Printf("Reloading layers on SIGHUP")
+		scanLayers()
+	}
+}
+
+func adminRoute(resp http.ResponseWriter, req *http.Request) {
+	if !checkAdminAuth(resp, req) {
+		return
+	}
+	switch req.URL.Path {
+	case "/admin/reload":
+		if !checkMethod(resp, req, postMethods) {
+			return
+		}
+		if frozen.Load() {
+			http.Error(resp, "layer registry is frozen", http.StatusConflict)
+			return
+		}
+		writeJSON(resp, req, scanLayers())
+	case "/admin/maintenance":
+		if checkMethod(resp, req, postMethods) {
+			maintenanceResponse(resp, req)
+		}
+	case "/admin/freeze":
+		if checkMethod(resp, req, postMethods) {
+			freezeResponse(resp, req)
+		}
+	case "/admin/layers":
+		if checkMethod(resp, req, readMethods) {
+			adminLayersResponse(resp, req)
+		}
+	default:
+		fields := strings.Split(req.URL.Path, "/")
+		// Names of tenant layers contain a slash, so they span two fields.
+		if (len(fields) == 5 || len(fields) == 6) && fields[2] == "layers" && fields[len(fields)-1] == "close" {
+			if checkMethod(resp, req, postMethods) {
+				adminCloseLayerResponse(resp, req, strings.Join(fields[3:len(fields)-1], "/"))
+			}
+			return
+		}
+		http.NotFound(resp, req)
+	}
+}
+
+type LayerStatus struct {
+	Name            string     `json:"name"`
+	Path            string     `json:"path"`
+	Valid           bool       `json:"valid"`
+	Closed          bool       `json:"closed"`
+	OpenConnections int        `json:"open_connections"`
+	InUse           int        `json:"in_use"`
+	Idle            int        `json:"idle"`
+	LastAccess      *time.Time `json:"last_access,omitempty"`
+	LastError       string     `json:"last_error,omitempty"`
+	LastErrorTime   *time.Time `json:"last_error_time,omitempty"`
+}
+
+func adminLayersResponse(resp http.ResponseWriter, req *http.Request) {
+	statuses := make([]LayerStatus, 0)
+	startingRequests.RLock()
+	for name, layer := range layers {
+		status := LayerStatus{Name: name, Path: layer.path, Valid: layer.valid}
+		if layer.valid && layer.conn != nil {
+			stats := layer.conn.Stats()
+			status.OpenConnections, status.InUse, status.Idle = stats.OpenConnections, stats.InUse, stats.Idle
+		}
+		if nanos := layer.lastAccess.Load(); nanos != 0 {
+			t := time.Unix(0, nanos)
+			status.LastAccess = &t
+		}
+		if err, t := layer.lastError(); err != nil {
+			status.LastError, status.LastErrorTime = err.Error(), &t
+		}
+		statuses = append(statuses, status)
+	}
+	for name, path := range closedLayers {
+		statuses = append(statuses, LayerStatus{Name: name, Path: path, Closed: true})
+	}
+	startingRequests.RUnlock()
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	writeJSON(resp, req, statuses)
+}
+
+func adminCloseLayerResponse(resp http.ResponseWriter, req *http.Request, name string) {
+	if frozen.Load() {
+		http.Error(resp, "layer registry is frozen", http.StatusConflict)
+		return
+	}
+	if !closeLayer(name) {
+		http.NotFound(resp, req)
+		return
+	}
+	writeJSON(resp, req, map[string]string{"closed": name})
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+)
+
+// apiKeys maps each API key to the globs of layer names it may access, e.g.
+// {"secret": ["tenant1_*"]}. When it is empty, layers are public.
+var apiKeys map[string][]string
+
+func loadAPIKeys(filename string) (map[string][]string, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var keys map[string][]string
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, err
+	}
+	for _, globs := range keys {
+		for _, glob := range globs {
+			if _, err := path.Match(glob, ""); err != nil {
+				return nil, fmt.Errorf("invalid layer pattern \"%s\"", glob)
+			}
+		}
+	}
+	return keys, nil
+}
+
+// requestAPIKey returns the key of the X-API-Key header, or of the key query
+// parameter for clients that can only set tile URLs.
+func requestAPIKey(req *http.Request) string {
+	if key := req.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	return req.URL.Query().Get("key")
+}
+
+// keyGlobs returns the layer globs of the request's key, and false if the
+// request has no known key.
+func keyGlobs(req *http.Request) ([]string, bool) {
+	key := requestAPIKey(req)
+	var globs []string
+	known := false
+	for k, g := range apiKeys {
+		if subtle.ConstantTimeCompare([]byte(k), []byte(key)) == 1 {
+			globs, known = g, true
+		}
+	}
+	return globs, known
+}
+
+func matchesAnyGlob(globs []string, name string) bool {
+	for _, glob := range globs {
+		if ok, _ := path.Match(glob, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// checkLayerAccess reports whether the request may access the layer. It
+// answers 401 to requests without a known key and 403 to keys not allowed
+// to access the layer.
+func checkLayerAccess(resp http.ResponseWriter, req *http.Request, name string) bool {
+	if len(apiKeys) == 0 {
+		return true
+	}
+	globs, known := keyGlobs(req)
+	if !known {
+		http.Error(resp, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	if !matchesAnyGlob(globs, name) {
+		http.Error(resp, "forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// layerFilter returns whether the request may access a layer, for leaving
+// the other layers out of listings. Requests without a known key may not
+// access any. It returns nil, allowing all layers, if there are no keys.
+func layerFilter(req *http.Request) func(name string) bool {
+	if len(apiKeys) == 0 {
+		return nil
+	}
+	globs, known := keyGlobs(req)
+	return func(name string) bool {
+		return known && matchesAnyGlob(globs, name)
+	}
+}
+
+// filterLayerNames returns the names allowed by filter, which may be nil.
+func filterLayerNames(names []string, allowed func(name string) bool) []string {
+	if allowed == nil {
+		return names
+	}
+	var result []string
+	for _, name := range names {
+		if allowed(name) {
+			result = append(result, name)
+		}
+	}
+	return result
+}
+
+// acquireRequestLayer is acquireLayer for handlers, checking access and
+// answering 404 for unknown layers. Access is checked first, so that clients
+// without a key can not tell which layers exist. Callers must release a
+// non-nil layer.
+func acquireRequestLayer(resp http.ResponseWriter, req *http.Request, name string) *Layer {
+	if !checkLayerAccess(resp, req, name) {
+		return nil
+	}
+	layer := acquireLayer(name)
+	if layer == nil {
+		http.NotFound(resp, req)
+	}
+	return layer
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+// TestAPIKeyBeforeLayerLookup checks that requests without access get the
+// same status whether the layer exists or not.
+func TestAPIKeyBeforeLayerLookup(t *testing.T) {
+	dir := t.TempDir()
+	writeTestMBTiles(t, filepath.Join(dir, "private.mbtiles"), map[string]string{"format": "png"},
+		map[[3]int][]byte{{0, 0, 0}: testPNG})
+	useDataDir(t, dir)
+	scanLayers()
+	saved := apiKeys
+	defer func() { apiKeys = saved }()
+	apiKeys = map[string][]string{"k1": {"*"}, "k2": {"public_*"}}
+
+	tests := []struct {
+		key  string
+		want int
+	}{
+		{"", http.StatusUnauthorized},
+		{"unknown", http.StatusUnauthorized},
+		{"k2", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		for _, path := range []string{"/private/0/0/0.png", "/missing/0/0/0.png", "/private.json", "/missing.json", "/private/metadata.json", "/missing/metadata.json"} {
+			resp := serveTest(http.MethodGet, path+"?key="+tt.key)
+			if resp.Code != tt.want {
+				t.Errorf("%s with key %q: status %d, want %d", path, tt.key, resp.Code, tt.want)
+			}
+		}
+	}
+	if resp := serveTest(http.MethodGet, "/missing/0/0/0.png?key=k1"); resp.Code != http.StatusNotFound {
+		t.Errorf("missing layer with a key: status %d, want 404", resp.Code)
+	}
+	if resp := serveTest(http.MethodGet, "/private/0/0/0.png?key=k1"); resp.Code != http.StatusOK {
+		t.Errorf("allowed layer: status %d, want 200", resp.Code)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+type tileKey struct {
+	layer   *Layer
+	format  string
+	scale   int
+	x, y, z int
+}
+
+type cacheEntry struct {
+	key         tileKey
+	data        []byte
+	contentType string
+}
+
+type TileCache struct {
+	mu       sync.Mutex
+	capacity int
+	entries  map[tileKey]*list.Element
+	order    *list.List
+}
+
+func newTileCache(capacity int) *TileCache {
+	return &TileCache{
+		capacity: capacity,
+		entries:  make(map[tileKey]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// get returns a cached tile and the content type it was stored with, which
+// is empty if the caller did not set one.
+func (cache *TileCache) get(key tileKey) ([]byte, string, bool) {
+	if cache == nil {
+		return nil, "", false
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	el, ok := cache.entries[key]
+	if !ok {
+		return nil, "", false
+	}
+	cache.order.MoveToFront(el)
+	entry := el.Value.(*cacheEntry)
+	return entry.data, entry.contentType, true
+}
+
+func (cache *TileCache) put(key tileKey, data []byte, contentType string) {
+	if cache == nil || cache.capacity <= 0 {
+		return
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if el, ok := cache.entries[key]; ok {
+		el.Value.(*cacheEntry).data = data
+		el.Value.(*cacheEntry).contentType = contentType
+		cache.order.MoveToFront(el)
+		return
+	}
+	cache.entries[key] = cache.order.PushFront(&cacheEntry{key, data, contentType})
+	for cache.order.Len() > cache.capacity {
+		el := cache.order.Back()
+		cache.order.Remove(el)
+		delete(cache.entries, el.Value.(*cacheEntry).key)
+	}
+}
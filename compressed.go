@@ -0,0 +1,119 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Data files compressed as a whole, such as "world.mbtiles.gz", are
+// decompressed into a temporary file in $TMPDIR when the layer is opened, and
+// the scan watches the compressed file.
+var compressedSuffixes = []string{".gz", ".zst"}
+
+func trimCompressedSuffix(path string) string {
+	for _, suffix := range compressedSuffixes {
+		if strings.HasSuffix(path, suffix) {
+			return strings.TrimSuffix(path, suffix)
+		}
+	}
+	return path
+}
+
+// layerBaseName is the name of a layer file without its extension and
+// compression suffix.
+func layerBaseName(path string) string {
+	base := trimCompressedSuffix(filepath.Base(path))
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// tempFiles holds the decompressed copies of layer files, which are removed
+// when their layer is disposed or the server is stopped by a signal.
+var (
+	tempFiles       = make(map[string]bool)
+	tempFilesMu     sync.Mutex
+	tempFilesOnExit sync.Once
+)
+
+func decompressLayerFile(filename string) (string, error) {
+	src, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	var r io.Reader
+	if strings.HasSuffix(filename, ".zst") {
+		zr, err := zstd.NewReader(src)
+		if err != nil {
+			return "", err
+		}
+		defer zr.Close()
+		r = zr
+	} else {
+		gz, err := gzip.NewReader(src)
+		if err != nil {
+			return "", err
+		}
+		r = gz
+	}
+	tmp, err := createTempFile(filename)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		removeTempFile(tmp.Name())
+		return "", fmt.Errorf("decompressing: %s", err)
+	}
+	return tmp.Name(), nil
+}
+
+// createTempFile creates a temporary file for a copy of the layer file
+// filename and registers it in tempFiles.
+func createTempFile(filename string) (*os.File, error) {
+	tmp, err := os.CreateTemp("", "mbtiles-*"+filepath.Ext(trimCompressedSuffix(filename)))
+	if err != nil {
+		return nil, err
+	}
+	tempFilesOnExit.Do(func() { go removeTempFilesOnExit() })
+	tempFilesMu.Lock()
+	tempFiles[tmp.Name()] = true
+	tempFilesMu.Unlock()
+	return tmp, nil
+}
+
+func removeTempFile(path string) {
+	tempFilesMu.Lock()
+	defer tempFilesMu.Unlock()
+	delete(tempFiles, path)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		log.Printf("Error removing \"%s\": %s", path, err)
+	}
+}
+
+// removeTempFilesOnExit removes the temporary files on SIGINT or SIGTERM and
+// then lets the signal terminate the process as it would by default.
+func removeTempFilesOnExit() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	sig := <-signals
+	// The lock is kept, so no new files are created while exiting.
+	tempFilesMu.Lock()
+	for path := range tempFiles {
+		os.Remove(path)
+	}
+	signal.Reset(sig)
+	syscall.Kill(os.Getpid(), sig.(syscall.Signal))
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// TestCompressedLayerFiles serves layers from whole-file gzip and zstd
+// compressed mbtiles files.
+func TestCompressedLayerFiles(t *testing.T) {
+	tests := []struct {
+		suffix   string
+		compress func(io.Writer) io.WriteCloser
+	}{
+		{".gz", func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }},
+		{".zst", func(w io.Writer) io.WriteCloser {
+			zw, _ := zstd.NewWriter(w)
+			return zw
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.suffix, func(t *testing.T) {
+			src := filepath.Join(t.TempDir(), "src.mbtiles")
+			writeTestMBTiles(t, src, map[string]string{"format": "png"}, map[[3]int][]byte{{0, 0, 0}: testPNG})
+			data, err := os.ReadFile(src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dir := t.TempDir()
+			f, err := os.Create(filepath.Join(dir, "c.mbtiles"+tt.suffix))
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := tt.compress(f)
+			w.Write(data)
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			f.Close()
+			useDataDir(t, dir)
+			scanLayers()
+
+			resp := serveTest(http.MethodGet, "/c/0/0/0.png")
+			if resp.Code != http.StatusOK || resp.Body.String() != string(testPNG) {
+				t.Errorf("status %d, body %q", resp.Code, resp.Body.Bytes())
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// layerConcurrency caps the tile requests of each layer handled at the same
+// time, so that a busy layer can not take all SQLite connections, 0 for no
+// cap. The "max_concurrency" key of a sidecar config overrides it for its
+// layer. Requests over the cap wait up to layerQueueTimeout for a slot, and
+// are then answered with 503.
+var layerConcurrency int
+var layerQueueTimeout = 100 * time.Millisecond
+
+func (layer *Layer) makeSlots() {
+	n := layer.config.MaxConcurrency
+	if n == 0 {
+		n = layerConcurrency
+	}
+	if n > 0 {
+		layer.slots = make(chan struct{}, n)
+	}
+}
+
+// acquireSlot waits for a request slot of the layer and reports whether it
+// got one. Callers that got it must call releaseSlot.
+func (layer *Layer) acquireSlot(ctx context.Context) bool {
+	if layer.slots == nil {
+		return true
+	}
+	select {
+	case layer.slots <- struct{}{}:
+		return true
+	default:
+	}
+	timer := time.NewTimer(layerQueueTimeout)
+	defer timer.Stop()
+	select {
+	case layer.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return false
+}
+
+func (layer *Layer) releaseSlot() {
+	if layer.slots != nil {
+		<-layer.slots
+	}
+}
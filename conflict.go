@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// onConflict selects what happens when several files map to the same layer
+// name, e.g. "osm.mbtiles" and "osm.pmtiles".
+var onConflict = "first"
+
+// reportedConflicts holds the paths of conflicting files already logged, so
+// that rescans do not repeat the message every second.
+var reportedConflicts = make(map[string]bool)
+
+// resolveConflicts names the layers of files of the source with prefix,
+// which are in scan order, and applies the -on-conflict policy to files
+// sharing a name. The conflicts found are added to reported, which replaces
+// reportedConflicts after the scan. It is called with scanMu held.
+func resolveConflicts(files []fileStat, prefix string, reported map[string]bool) []fileStat {
+	byName := make(map[string][]int)
+	var names []string
+	for i := range files {
+		file := &files[i]
+		file.rawName = singleName
+		if file.rawName == "" {
+			file.rawName = layerBaseName(file.path)
+		}
+		file.name = sanitizeLayerName(file.rawName)
+		if byName[file.name] == nil {
+			names = append(names, file.name)
+		}
+		byName[file.name] = append(byName[file.name], i)
+	}
+	var result []fileStat
+	for _, name := range names {
+		indexes := byName[name]
+		if len(indexes) == 1 {
+			result = append(result, files[indexes[0]])
+			continue
+		}
+		var paths []string
+		for _, i := range indexes {
+			paths = append(paths, files[i].path)
+		}
+		var kept []int
+		switch onConflict {
+		case "first":
+			kept = indexes[:1]
+		case "last":
+			kept = indexes[len(indexes)-1:]
+		case "suffix":
+			kept = indexes
+			for n, i := range indexes[1:] {
+				files[i].name = uniqueName(fmt.Sprintf("%s-%d", name, n+2), byName)
+			}
+		}
+		for _, i := range kept {
+			result = append(result, files[i])
+		}
+		key := strings.Join(paths, "\x00")
+		reported[key] = true
+		if reportedConflicts[key] {
+			continue
+		}
+		switch onConflict {
+		case "error":
+			log.Printf("Error: files %q all map to layer \"%s\", none of them is served", paths, name)
+		case "suffix":
+			for _, i := range indexes[1:] {
+				log.Printf("Warning: file \"%s\" maps to layer \"%s\" of \"%s\", serving it as \"%s\"",
+					files[i].path, name, paths[0], files[i].name)
+			}
+		default:
+			log.Printf("Warning: files %q all map to layer \"%s\", serving \"%s\"", paths, name, files[kept[0]].path)
+		}
+	}
+	if prefix != "" {
+		for i := range result {
+			result[i].name = prefix + "/" + result[i].name
+		}
+	}
+	return result
+}
+
+// uniqueName returns name, or name with a further suffix if some file
+// already maps to it.
+func uniqueName(name string, taken map[string][]int) string {
+	candidate := name
+	for n := 2; taken[candidate] != nil; n++ {
+		candidate = fmt.Sprintf("%s-%d", name, n)
+	}
+	taken[candidate] = []int{-1}
+	return candidate
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+var formatContentTypes = map[string]string{
+	"png":  "image/png",
+	"jpg":  "image/jpeg",
+	"jpeg": "image/jpeg",
+	"webp": "image/webp",
+	"gif":  "image/gif",
+	"pbf":  "application/x-protobuf",
+}
+
+// sniffTile guesses content type and content encoding of a tile from its
+// leading bytes. Unrecognized data is reported with an empty content type.
+func sniffTile(data []byte) (contentType, encoding string) {
+	switch {
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return "image/png", ""
+	case bytes.HasPrefix(data, []byte("\xff\xd8\xff")):
+		return "image/jpeg", ""
+	case len(data) >= 12 && bytes.Equal(data[:4], []byte("RIFF")) && bytes.Equal(data[8:12], []byte("WEBP")):
+		return "image/webp", ""
+	case bytes.HasPrefix(data, []byte("GIF8")):
+		return "image/gif", ""
+	case bytes.HasPrefix(data, []byte("\x1f\x8b")):
+		return sniffGzipped(data), "gzip"
+	}
+	return "", ""
+}
+
+// sniffGzipped returns the content type of gzip-compressed tile data. Vector
+// tiles are the usual case, but some files store gzip-wrapped raster images.
+func sniffGzipped(data []byte) string {
+	if r, err := gzip.NewReader(bytes.NewReader(data)); err == nil {
+		head := make([]byte, 12)
+		n, _ := io.ReadFull(r, head)
+		r.Close()
+		if contentType, encoding := sniffTile(head[:n]); strings.HasPrefix(contentType, "image/") && encoding == "" {
+			return contentType
+		}
+	}
+	return "application/x-protobuf"
+}
+
+// metadataEncodings maps values of the "compression" metadata key to content
+// codings. Brotli and zstd data have no reliable magic number to sniff.
+var metadataEncodings = map[string]string{"br": "br", "brotli": "br", "zstd": "zstd"}
+
+var alwaysSniff bool
+
+// detectFormat derives the content type and encoding shared by all tiles of
+// the layer from its metadata or config. Tiles may or may not be
+// gzip-compressed, so a sample tile decides their encoding.
+func (layer *Layer) detectFormat() {
+	contentType, ok := formatContentTypes[layer.metadata["format"]]
+	if layer.config.ContentType != "" {
+		contentType, ok = layer.config.ContentType, true
+	}
+	if !ok {
+		return
+	}
+	var sample []byte
+	err := layer.conn.QueryRow("SELECT " + quoteIdent(layer.config.Columns.Data) + " FROM " + layer.config.Columns.from() + " LIMIT 1").Scan(&sample)
+	if err != nil {
+		return
+	}
+	_, encoding := sniffTile(sample)
+	if encoding == "" {
+		encoding = metadataEncodings[layer.metadata["compression"]]
+	}
+	layer.formatType, layer.formatEncoding = contentType, encoding
+}
+
+func (layer *Layer) contentType(data []byte) (contentType, encoding string) {
+	if layer.formatType != "" && (!alwaysSniff || layer.config.ContentType != "") {
+		return layer.formatType, layer.formatEncoding
+	}
+	contentType, encoding = sniffTile(data)
+	if encoding == "" {
+		encoding = metadataEncodings[layer.metadata["compression"]]
+	}
+	if contentType == "" {
+		contentType = formatContentTypes[layer.metadata["format"]]
+	}
+	if contentType == "" {
+		contentType = "image/png"
+	}
+	return
+}
+
+// acceptsEncoding reports whether the request's Accept-Encoding header allows
+// the given coding with a non-zero quality.
+func acceptsEncoding(req *http.Request, coding string) bool {
+	return accepts(req, "Accept-Encoding", coding, "*")
+}
+
+// acceptsType reports whether the request's Accept header lists the given
+// media type with a non-zero quality. Wildcards do not count, as clients send
+// "*/*" without being able to decode every type.
+func acceptsType(req *http.Request, mediaType string) bool {
+	return accepts(req, "Accept", mediaType, "")
+}
+
+// accepts reports whether the header allows value, or the wildcard if it is
+// not empty, with a non-zero quality.
+func accepts(req *http.Request, header, value, wildcard string) bool {
+	for _, header := range req.Header.Values(header) {
+		for _, item := range strings.Split(header, ",") {
+			params := strings.Split(item, ";")
+			name := strings.TrimSpace(params[0])
+			if name != value && (wildcard == "" || name != wildcard) {
+				continue
+			}
+			accepted := true
+			for _, param := range params[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					q, err := strconv.ParseFloat(param[2:], 64)
+					accepted = err == nil && q > 0
+				}
+			}
+			if accepted {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// encodeHeaderValue makes arbitrary text safe for use as a header value.
+// Non-ASCII text is encoded as an RFC 2047 encoded-word.
+func encodeHeaderValue(s string) string {
+	s = strings.Join(strings.Fields(s), " ")
+	return mime.QEncoding.Encode("utf-8", s)
+}
+
+// tileDecoders decompress tiles stored in a content coding that the client
+// does not accept.
+var tileDecoders = map[string]func([]byte) ([]byte, error){"gzip": gunzip, "br": unbrotli, "zstd": unzstd}
+
+// encodingNotAccepted is the 406 message for tiles stored in an encoding that
+// the client does not accept and the server can not decode.
+func encodingNotAccepted(encoding string) string {
+	return "tile is stored with " + encoding + " encoding, which the request does not accept"
+}
+
+func gunzip(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func unbrotli(data []byte) ([]byte, error) {
+	return io.ReadAll(brotli.NewReader(bytes.NewReader(data)))
+}
+
+// zstdDecoder decodes zstd tiles. Its DecodeAll is safe for concurrent use.
+var zstdDecoder, _ = zstd.NewReader(nil)
+
+func unzstd(data []byte) ([]byte, error) {
+	return zstdDecoder.DecodeAll(data, nil)
+}
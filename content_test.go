@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestBrotliTiles(t *testing.T) {
+	pbf := []byte("\x1a\x05layer raw protobuf bytes")
+	var compressed bytes.Buffer
+	w := brotli.NewWriter(&compressed)
+	w.Write(pbf)
+	w.Close()
+	dir := t.TempDir()
+	writeTestMBTiles(t, filepath.Join(dir, "v.mbtiles"), map[string]string{"format": "pbf", "compression": "br"},
+		map[[3]int][]byte{{0, 0, 0}: compressed.Bytes()})
+	useDataDir(t, dir)
+	scanLayers()
+
+	tests := []struct {
+		name, method, accept string
+		encoding             string
+		body                 []byte
+	}{
+		{"passthrough", http.MethodGet, "gzip, br", "br", compressed.Bytes()},
+		{"decompress", http.MethodGet, "gzip", "", pbf},
+		{"decompress without Accept-Encoding", http.MethodGet, "", "", pbf},
+		{"br refused with q=0", http.MethodGet, "br;q=0, gzip", "", pbf},
+		{"HEAD passthrough", http.MethodHead, "br", "br", nil},
+		{"HEAD decompress", http.MethodHead, "gzip", "", nil},
+	}
+	for _, tt := range tests {
+		var header []string
+		if tt.accept != "" {
+			header = append(header, "Accept-Encoding: "+tt.accept)
+		}
+		resp := serveTest(tt.method, "/v/0/0/0.pbf", header...)
+		if resp.Code != http.StatusOK {
+			t.Errorf("%s: status %d, want 200", tt.name, resp.Code)
+			continue
+		}
+		if got := resp.Header().Get("Content-Encoding"); got != tt.encoding {
+			t.Errorf("%s: Content-Encoding %q, want %q", tt.name, got, tt.encoding)
+		}
+		if got := resp.Header().Get("Content-Type"); got != "application/x-protobuf" {
+			t.Errorf("%s: Content-Type %q", tt.name, got)
+		}
+		if got := resp.Header().Get("Vary"); got != "Accept-Encoding" {
+			t.Errorf("%s: Vary %q, want Accept-Encoding", tt.name, got)
+		}
+		if tt.method == http.MethodGet && !bytes.Equal(resp.Body.Bytes(), tt.body) {
+			t.Errorf("%s: body %q, want %q", tt.name, resp.Body.Bytes(), tt.body)
+		}
+	}
+}
+
+func gzipBytes(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestGzipTiles(t *testing.T) {
+	pbf := []byte("\x1a\x05layer raw protobuf bytes")
+	compressed := gzipBytes(t, pbf)
+	dir := t.TempDir()
+	writeTestMBTiles(t, filepath.Join(dir, "v.mbtiles"), map[string]string{"format": "pbf"},
+		map[[3]int][]byte{{0, 0, 0}: compressed})
+	useDataDir(t, dir)
+	scanLayers()
+
+	tests := []struct {
+		name, accept string
+		encoding     string
+		body         []byte
+	}{
+		{"accepting client", "gzip, deflate", "gzip", compressed},
+		{"accepting any coding", "*", "gzip", compressed},
+		{"non-accepting client", "deflate", "", pbf},
+		{"no Accept-Encoding", "", "", pbf},
+		{"gzip refused with q=0", "gzip;q=0", "", pbf},
+	}
+	for _, tt := range tests {
+		var header []string
+		if tt.accept != "" {
+			header = append(header, "Accept-Encoding: "+tt.accept)
+		}
+		resp := serveTest(http.MethodGet, "/v/0/0/0.pbf", header...)
+		if resp.Code != http.StatusOK {
+			t.Errorf("%s: status %d, want 200", tt.name, resp.Code)
+			continue
+		}
+		if got := resp.Header().Get("Content-Encoding"); got != tt.encoding {
+			t.Errorf("%s: Content-Encoding %q, want %q", tt.name, got, tt.encoding)
+		}
+		if got := resp.Header().Get("Content-Type"); got != "application/x-protobuf" {
+			t.Errorf("%s: Content-Type %q", tt.name, got)
+		}
+		if !bytes.Equal(resp.Body.Bytes(), tt.body) {
+			t.Errorf("%s: body %q, want %q", tt.name, resp.Body.Bytes(), tt.body)
+		}
+	}
+}
+
+func TestSniffGzippedRaster(t *testing.T) {
+	jpeg := []byte("\xff\xd8\xff\xe0 jpeg data")
+	tests := []struct {
+		name        string
+		data        []byte
+		contentType string
+		encoding    string
+	}{
+		{"PNG", testPNG, "image/png", ""},
+		{"gzipped PNG", gzipBytes(t, testPNG), "image/png", "gzip"},
+		{"gzipped JPEG", gzipBytes(t, jpeg), "image/jpeg", "gzip"},
+		{"gzipped protobuf", gzipBytes(t, []byte("\x1a\x05layer")), "application/x-protobuf", "gzip"},
+		{"gzipped gzip", gzipBytes(t, gzipBytes(t, testPNG)), "application/x-protobuf", "gzip"},
+		{"truncated gzip", []byte("\x1f\x8b\x08"), "application/x-protobuf", "gzip"},
+	}
+	for _, tt := range tests {
+		contentType, encoding := sniffTile(tt.data)
+		if contentType != tt.contentType || encoding != tt.encoding {
+			t.Errorf("%s: sniffTile = %q, %q, want %q, %q", tt.name, contentType, encoding, tt.contentType, tt.encoding)
+		}
+	}
+}
+
+func TestGzippedPNGTile(t *testing.T) {
+	compressed := gzipBytes(t, testPNG)
+	dir := t.TempDir()
+	tiles := map[[3]int][]byte{{0, 0, 0}: compressed}
+	writeTestMBTiles(t, filepath.Join(dir, "r.mbtiles"), map[string]string{"format": "png"}, tiles)
+	// Without a format, each tile is sniffed.
+	writeTestMBTiles(t, filepath.Join(dir, "s.mbtiles"), nil, tiles)
+	useDataDir(t, dir)
+	scanLayers()
+
+	for _, layer := range []string{"r", "s"} {
+		resp := serveTest(http.MethodGet, "/"+layer+"/0/0/0.png", "Accept-Encoding: gzip")
+		if resp.Header().Get("Content-Type") != "image/png" || resp.Header().Get("Content-Encoding") != "gzip" ||
+			!bytes.Equal(resp.Body.Bytes(), compressed) {
+			t.Errorf("layer %s, accepting gzip: got %d %v %q", layer, resp.Code, resp.Header(), resp.Body.Bytes())
+		}
+		resp = serveTest(http.MethodGet, "/"+layer+"/0/0/0.png")
+		if resp.Header().Get("Content-Type") != "image/png" || resp.Header().Get("Content-Encoding") != "" ||
+			!bytes.Equal(resp.Body.Bytes(), testPNG) {
+			t.Errorf("layer %s, not accepting gzip: got %d %v %q", layer, resp.Code, resp.Header(), resp.Body.Bytes())
+		}
+	}
+}
+
+func TestZstdTiles(t *testing.T) {
+	pbf := []byte("\x1a\x05layer raw protobuf bytes")
+	enc, _ := zstd.NewWriter(nil)
+	compressed := enc.EncodeAll(pbf, nil)
+	dir := t.TempDir()
+	writeTestMBTiles(t, filepath.Join(dir, "v.mbtiles"), map[string]string{"format": "pbf", "compression": "zstd"},
+		map[[3]int][]byte{{0, 0, 0}: compressed})
+	useDataDir(t, dir)
+	scanLayers()
+
+	tests := []struct {
+		name, accept string
+		encoding     string
+		body         []byte
+	}{
+		{"passthrough", "gzip, zstd", "zstd", compressed},
+		{"decompress", "gzip, br", "", pbf},
+		{"decompress without Accept-Encoding", "", "", pbf},
+	}
+	for _, tt := range tests {
+		var header []string
+		if tt.accept != "" {
+			header = append(header, "Accept-Encoding: "+tt.accept)
+		}
+		resp := serveTest(http.MethodGet, "/v/0/0/0.pbf", header...)
+		if resp.Code != http.StatusOK {
+			t.Errorf("%s: status %d, want 200", tt.name, resp.Code)
+			continue
+		}
+		if got := resp.Header().Get("Content-Encoding"); got != tt.encoding {
+			t.Errorf("%s: Content-Encoding %q, want %q", tt.name, got, tt.encoding)
+		}
+		if !bytes.Equal(resp.Body.Bytes(), tt.body) {
+			t.Errorf("%s: body %q, want %q", tt.name, resp.Body.Bytes(), tt.body)
+		}
+	}
+}
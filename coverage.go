@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// coverageMaxZoom bounds the zoom of /{layer}/coverage.geojson, as the
+// response has up to one rectangle per row of tiles.
+const coverageMaxZoom = 12
+
+// coverageStats caches the encoded coverage documents of a layer by zoom.
+// Like gridStats it stays valid for the lifetime of the Layer.
+type coverageStats struct {
+	mu     sync.Mutex
+	byZoom map[int][]byte
+}
+
+// coverageRows returns the sorted columns of the tiles present at zoom z of
+// tile URLs by their XYZ row.
+func (layer *Layer) coverageRows(ctx context.Context, z int) (map[int][]int, error) {
+	rows := make(map[int][]int)
+	if !layer.config.servesZoom(z) {
+		return rows, nil
+	}
+	n := 1 << uint(z)
+	storedZ := z + layer.config.ZoomOffset
+	if storedZ < 0 || storedZ > 30 {
+		return rows, nil
+	}
+	if layer.pmtiles != nil {
+		storedN := uint64(1) << uint(storedZ)
+		first := ((uint64(1) << (2 * uint(storedZ))) - 1) / 3
+		last := first + storedN*storedN
+		err := layer.pmtiles.walk(func(entry pmtilesEntry) {
+			if entry.length == 0 && !serveEmptyTiles {
+				return
+			}
+			start, end := entry.tileID, entry.tileID+uint64(entry.runLength)
+			if start < first {
+				start = first
+			}
+			if end > last {
+				end = last
+			}
+			for id := start; id < end; id++ {
+				x, y := pmtilesTileXY(uint(storedZ), id-first)
+				ty := layer.config.Rows.tmsRow(int(storedN)-1-int(y), z)
+				if int(x) >= n || ty < 0 || ty >= n {
+					continue
+				}
+				rows[n-1-ty] = append(rows[n-1-ty], int(x))
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		c := layer.config.Columns
+		query := fmt.Sprintf("SELECT %s, %s FROM %s WHERE %s = ?", quoteIdent(c.Column), quoteIdent(c.Row), c.from(), quoteIdent(c.Zoom))
+		if !serveEmptyTiles {
+			query += " AND length(" + quoteIdent(c.Data) + ") > 0"
+		}
+		result, err := layer.conn.QueryContext(ctx, query, storedZ)
+		if err != nil {
+			return nil, err
+		}
+		defer result.Close()
+		for result.Next() {
+			var x, stored int
+			if err := result.Scan(&x, &stored); err != nil {
+				return nil, err
+			}
+			y := layer.config.Rows.tmsRow(stored, z)
+			if x < 0 || x >= n || y < 0 || y >= n {
+				continue
+			}
+			rows[n-1-y] = append(rows[n-1-y], x)
+		}
+		if err := result.Err(); err != nil {
+			return nil, err
+		}
+	}
+	for _, columns := range rows {
+		sort.Ints(columns)
+	}
+	return rows, nil
+}
+
+// pmtilesTileXY is the inverse of the Hilbert curve part of pmtilesTileID:
+// it maps the position of a tile along the curve of zoom z to XYZ
+// coordinates.
+func pmtilesTileXY(z uint, pos uint64) (x, y uint32) {
+	var tx, ty uint64
+	for s := uint64(1); s < uint64(1)<<z; s *= 2 {
+		rx := 1 & (pos / 2)
+		ry := 1 & (pos ^ rx)
+		if ry == 0 {
+			if rx == 1 {
+				tx, ty = s-1-tx, s-1-ty
+			}
+			tx, ty = ty, tx
+		}
+		tx += s * rx
+		ty += s * ry
+		pos /= 4
+	}
+	return uint32(tx), uint32(ty)
+}
+
+// coverageRects merges tiles into rectangles [x0, y0, x1, y1) in tile units:
+// runs of adjacent columns of a row, extended over the following rows with
+// the same run.
+func coverageRects(rows map[int][]int) [][4]int {
+	ys := make([]int, 0, len(rows))
+	for y := range rows {
+		ys = append(ys, y)
+	}
+	sort.Ints(ys)
+	var rects [][4]int
+	open := make(map[[2]int]int)
+	for _, y := range ys {
+		next := make(map[[2]int]int)
+		columns := rows[y]
+		for i := 0; i < len(columns); {
+			j := i
+			for j+1 < len(columns) && columns[j+1] <= columns[j]+1 {
+				j++
+			}
+			run := [2]int{columns[i], columns[j] + 1}
+			if k, ok := open[run]; ok && rects[k][3] == y {
+				rects[k][3] = y + 1
+				next[run] = k
+			} else {
+				rects = append(rects, [4]int{run[0], y, run[1], y + 1})
+				next[run] = len(rects) - 1
+			}
+			i = j + 1
+		}
+		open = next
+	}
+	return rects
+}
+
+// coverageGeoJSON encodes the tiles of rows as a GeoJSON feature with a
+// MultiPolygon of rectangles, which may share edges.
+func coverageGeoJSON(z int, rows map[int][]int) ([]byte, error) {
+	n := float64(int(1) << uint(z))
+	lon := func(x int) float64 { return float64(x)/n*360 - 180 }
+	lat := func(y int) float64 { return math.Atan(math.Sinh(math.Pi*(1-2*float64(y)/n))) * 180 / math.Pi }
+	polygons := [][][][2]float64{}
+	for _, r := range coverageRects(rows) {
+		west, north, east, south := lon(r[0]), lat(r[1]), lon(r[2]), lat(r[3])
+		polygons = append(polygons, [][][2]float64{{{west, south}, {east, south}, {east, north}, {west, north}, {west, south}}})
+	}
+	tiles := 0
+	for _, columns := range rows {
+		tiles += len(columns)
+	}
+	return json.Marshal(map[string]interface{}{
+		"type":       "Feature",
+		"properties": map[string]int{"zoom": z, "tiles": tiles},
+		"geometry":   map[string]interface{}{"type": "MultiPolygon", "coordinates": polygons},
+	})
+}
+
+// coverageResponse serves /{layer}/coverage.geojson?z=N with the area
+// covered by the tiles of zoom N, by default the minimum zoom of the layer.
+func coverageResponse(resp http.ResponseWriter, req *http.Request) {
+	urlFields := layerPathFields(req.URL.Path)
+	if len(urlFields) != 3 {
+		http.NotFound(resp, req)
+		return
+	}
+	name := urlFields[1]
+	layer := acquireRequestLayer(resp, req, name)
+	if layer == nil {
+		return
+	}
+	defer layer.activeRequests.Done()
+	if !layer.valid {
+		http.Error(resp, "layer invalid", 500)
+		return
+	}
+	z, _ := layer.urlZoomRange()
+	if z > coverageMaxZoom {
+		z = coverageMaxZoom
+	}
+	if v := req.URL.Query().Get("z"); v != "" {
+		var err error
+		if z, err = strconv.Atoi(v); err != nil || z < 0 || z > coverageMaxZoom {
+			http.Error(resp, fmt.Sprintf("z must be an integer from 0 to %d", coverageMaxZoom), http.StatusBadRequest)
+			return
+		}
+	}
+	layer.coverage.mu.Lock()
+	defer layer.coverage.mu.Unlock()
+	doc, ok := layer.coverage.byZoom[z]
+	if !ok {
+		select {
+		case gridScans <- struct{}{}:
+		default:
+			resp.Header().Set("Retry-After", "1")
+			http.Error(resp, "tile scan in progress", http.StatusTooManyRequests)
+			return
+		}
+		rows, err := layer.coverageRows(req.Context(), z)
+		<-gridScans
+		if err == nil {
+			doc, err = coverageGeoJSON(z, rows)
+		}
+		if err != nil {
+			if req.Context().Err() == nil {
+				log.Printf("Error computing coverage of layer \"%s\": %s", name, err)
+				http.Error(resp, "", 500)
+			}
+			return
+		}
+		if layer.coverage.byZoom == nil {
+			layer.coverage.byZoom = make(map[int][]byte)
+		}
+		layer.coverage.byZoom[z] = doc
+	}
+	allowOrigin(resp, req)
+	resp.Header().Set("Content-Type", "application/geo+json")
+	resp.Write(doc)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"image"
+	_ "image/gif"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// tileDimensions adds X-Tile-Width and X-Tile-Height to raster tiles, read
+// from the image header. WebP has no decoder in the standard library, so
+// those tiles get no headers.
+var tileDimensions bool
+
+// dimensionSamples is the number of tiles of equal size after which that size
+// is assumed for the whole layer, without reading more headers.
+const dimensionSamples = 16
+
+type tileDims struct {
+	mu            sync.Mutex
+	width, height int
+	// samples counts tiles of the same size, and is -1 once sizes differed.
+	samples int
+}
+
+func (d *tileDims) homogeneous() (width, height int, ok bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.width, d.height, d.samples >= dimensionSamples
+}
+
+func (d *tileDims) known() bool {
+	_, _, ok := d.homogeneous()
+	return ok
+}
+
+func (d *tileDims) record(width, height int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.samples == 0 || d.samples > 0 && d.width == width && d.height == height {
+		d.width, d.height = width, height
+		d.samples++
+	} else {
+		d.samples = -1
+	}
+}
+
+// setHeaders sets the dimension headers of a tile from the layer's known size
+// or by reading the image header from r. r may be nil if the tile is not
+// loaded, and then the headers are set only if the size is known.
+func (d *tileDims) setHeaders(resp http.ResponseWriter, contentType string, r io.Reader) {
+	if !tileDimensions || !strings.HasPrefix(contentType, "image/") {
+		return
+	}
+	width, height, ok := d.homogeneous()
+	if !ok {
+		if r == nil {
+			return
+		}
+		config, _, err := image.DecodeConfig(r)
+		if err != nil {
+			return
+		}
+		width, height = config.Width, config.Height
+		d.record(width, height)
+	}
+	resp.Header().Set("X-Tile-Width", strconv.Itoa(width))
+	resp.Header().Set("X-Tile-Height", strconv.Itoa(height))
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// errorStatus maps classes of tile read errors to the status answered
+// instead of 500, set with -error-status, e.g. "busy=503,corrupt=404".
+var errorStatus = map[string]int{}
+
+// errorDetail includes the error text in bodies of failed tile responses.
+var errorDetail bool
+
+var errorClasses = []string{"busy", "corrupt", "io", "too-large", "other"}
+
+func errorClass(err error) string {
+	var sqliteErr sqlite3.Error
+	switch {
+	case isBusy(err):
+		return "busy"
+	case errors.Is(err, errTileTooLarge):
+		return "too-large"
+	case errors.As(err, &sqliteErr) && (sqliteErr.Code == sqlite3.ErrCorrupt || sqliteErr.Code == sqlite3.ErrNotADB):
+		return "corrupt"
+	case errors.As(err, &sqliteErr) && sqliteErr.Code == sqlite3.ErrIoErr:
+		return "io"
+	}
+	return "other"
+}
+
+func parseErrorStatus(s string) (map[string]int, error) {
+	result := make(map[string]int)
+	if s == "" {
+		return result, nil
+	}
+	for _, item := range strings.Split(s, ",") {
+		class, code, ok := strings.Cut(strings.TrimSpace(item), "=")
+		status, err := strconv.Atoi(code)
+		if !ok || err != nil || (status != 404 && status != 500 && status != 503) {
+			return nil, fmt.Errorf("invalid entry \"%s\", expected class=404, 500 or 503", item)
+		}
+		known := false
+		for _, c := range errorClasses {
+			known = known || c == class
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown error class \"%s\", expected one of %s", class, strings.Join(errorClasses, ", "))
+		}
+		result[class] = status
+	}
+	return result, nil
+}
+
+// tileErrorResponse answers a request whose tile could not be read.
+func tileErrorResponse(resp http.ResponseWriter, err error) {
+	status, ok := errorStatus[errorClass(err)]
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+	if status == http.StatusServiceUnavailable {
+		resp.Header().Set("Retry-After", "1")
+	}
+	body := ""
+	if errorDetail {
+		body = err.Error()
+	}
+	http.Error(resp, body, status)
+}
+
+// notFoundBody, read from the -notfound-body file, answers requests for paths
+// matching no route. Missing tiles and layers keep the plain 404.
+var notFoundBody []byte
+var notFoundType string
+
+func loadNotFoundBody(filename string) (err error) {
+	if notFoundBody, err = os.ReadFile(filename); err != nil {
+		return
+	}
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json":
+		notFoundType = "application/json"
+	case ".html", ".htm":
+		notFoundType = "text/html; charset=utf-8"
+	default:
+		notFoundType = http.DetectContentType(notFoundBody)
+	}
+	return nil
+}
+
+func notFoundResponse(resp http.ResponseWriter, req *http.Request) {
+	if notFoundBody == nil {
+		http.NotFound(resp, req)
+		return
+	}
+	resp.Header().Set("Content-Type", notFoundType)
+	resp.Header().Set("X-Content-Type-Options", "nosniff")
+	resp.WriteHeader(http.StatusNotFound)
+	if req.Method != http.MethodHead {
+		resp.Write(notFoundBody)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// prepareTileIDQuery prepares a query of the tile_id of a tile for files with
+// the deduplicated schema, where tiles is a view joining the map and images
+// tables. A tile_id identifies the content of a tile, so it serves as its
+// ETag without reading or hashing the tile data.
+func (layer *Layer) prepareTileIDQuery() {
+	var standard TileColumns
+	standard.setDefaults("tiles")
+	if layer.config.Columns != standard {
+		return
+	}
+	images, err := tableColumns(layer.conn, "images")
+	if err != nil || !images["tile_id"] {
+		return
+	}
+	columns := TileColumns{Table: "map", Data: "tile_id"}
+	columns.setDefaults("")
+	layer.tileIDStmt, _ = layer.prepareTileQuery(columns)
+}
+
+// weakETag is the ETag of tiles of layers without tile IDs. It changes
+// whenever the file does.
+func (layer *Layer) weakETag() string {
+	return fmt.Sprintf(`W/"%x"`, layer.mtime.UnixNano())
+}
+
+// variantETag is the weak ETag of tiles of a format negotiated by the Accept
+// header, which differs from that of the tiles served to other clients.
+func (layer *Layer) variantETag(format string) string {
+	return fmt.Sprintf(`W/"%x-%s"`, layer.mtime.UnixNano(), format)
+}
+
+// decodedETag returns the ETag of a tile decoded for a client not accepting
+// its stored encoding, given that of the stored tile. The weak ETags are
+// those of the whole layer, so they get the suffix that tileETag adds to
+// strong ones.
+func decodedETag(etag string) string {
+	if !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return strings.TrimSuffix(etag, `"`) + `-identity"`
+}
+
+// tileETag returns a strong ETag from the tile_id of a tile, or "" if the
+// layer has no tile IDs or the tile does not exist. Clients not accepting
+// the stored encoding get the decoded tile, which is another representation
+// and gets another ETag.
+func (layer *Layer) tileETag(ctx context.Context, req *http.Request, x, y, z int) (string, error) {
+	if layer.tileIDStmt == nil {
+		return "", nil
+	}
+	id, err := queryTile(ctx, layer.tileIDStmt, x, y, z)
+	if err != nil || id == nil {
+		return "", err
+	}
+	tag := string(id)
+	if strings.ContainsAny(tag, "\"\\") || strings.IndexFunc(tag, func(r rune) bool { return r < 0x21 || r > 0x7e }) >= 0 {
+		tag = fmt.Sprintf("%x", id)
+	}
+	if layer.formatEncoding != "" && !acceptsEncoding(req, layer.formatEncoding) {
+		tag += "-identity"
+	}
+	return `"` + tag + `"`, nil
+}
+
+// etagMatches reports whether If-None-Match of the request lists etag,
+// using the weak comparison required for it.
+func etagMatches(req *http.Request, etag string) bool {
+	for _, candidate := range strings.Split(req.Header.Get("If-None-Match"), ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
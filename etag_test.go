@@ -0,0 +1,140 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeDedupMBTiles creates an mbtiles file with the deduplicated schema,
+// where tiles is a view joining map and images. tiles maps z, x and TMS y
+// to tile IDs and images maps tile IDs to data.
+func writeDedupMBTiles(t *testing.T, path string, tiles map[[3]int]string, images map[string][]byte) {
+	t.Helper()
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, stmt := range []string{
+		"CREATE TABLE metadata (name TEXT, value TEXT)",
+		"INSERT INTO metadata VALUES ('format', 'png')",
+		"CREATE TABLE map (zoom_level INTEGER, tile_column INTEGER, tile_row INTEGER, tile_id TEXT)",
+		"CREATE TABLE images (tile_data BLOB, tile_id TEXT)",
+		"CREATE VIEW tiles AS SELECT map.zoom_level AS zoom_level, map.tile_column AS tile_column, map.tile_row AS tile_row, images.tile_data AS tile_data FROM map JOIN images ON images.tile_id = map.tile_id",
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for c, id := range tiles {
+		if _, err := db.Exec("INSERT INTO map VALUES (?, ?, ?, ?)", c[0], c[1], c[2], id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for id, data := range images {
+		if _, err := db.Exec("INSERT INTO images VALUES (?, ?)", data, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestDedupTileETag checks that tiles of the deduplicated schema get their
+// tile_id as a strong ETag, hex-encoded if it can not be quoted, while other
+// layers get a weak one.
+func TestDedupTileETag(t *testing.T) {
+	dir := t.TempDir()
+	writeDedupMBTiles(t, filepath.Join(dir, "dedup.mbtiles"),
+		map[[3]int]string{{1, 0, 0}: "abc123", {1, 1, 0}: "abc123", {1, 0, 1}: `a "quoted" id`},
+		map[string][]byte{"abc123": testPNG, `a "quoted" id`: testPNG})
+	writeTestMBTiles(t, filepath.Join(dir, "plain.mbtiles"), map[string]string{"format": "png"},
+		map[[3]int][]byte{{0, 0, 0}: testPNG})
+	useDataDir(t, dir)
+	scanLayers()
+
+	tests := []struct {
+		path, ifNoneMatch string
+		code              int
+		etag              string
+	}{
+		{"/dedup/1/0/0.png", "", http.StatusOK, `"abc123"`},
+		{"/dedup/1/1/0.png", "", http.StatusOK, `"abc123"`},
+		{"/dedup/1/0/1.png", "", http.StatusOK, `"61202271756f74656422206964"`},
+		{"/dedup/1/0/0.png", `"other", "abc123"`, http.StatusNotModified, `"abc123"`},
+		{"/dedup/1/0/0.png", `W/"abc123"`, http.StatusNotModified, `"abc123"`},
+		{"/dedup/1/0/0.png", `"other"`, http.StatusOK, `"abc123"`},
+		{"/dedup/1/1/1.png", "", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		var header []string
+		if tt.ifNoneMatch != "" {
+			header = append(header, "If-None-Match: "+tt.ifNoneMatch)
+		}
+		resp := serveTest(http.MethodGet, tt.path, header...)
+		if resp.Code != tt.code {
+			t.Errorf("%s If-None-Match %s: status %d, want %d", tt.path, tt.ifNoneMatch, resp.Code, tt.code)
+		}
+		if got := resp.Header().Get("ETag"); got != tt.etag {
+			t.Errorf("%s If-None-Match %s: ETag %s, want %s", tt.path, tt.ifNoneMatch, got, tt.etag)
+		}
+	}
+
+	resp := serveTest(http.MethodGet, "/plain/0/0/0.png")
+	if etag := resp.Header().Get("ETag"); !strings.HasPrefix(etag, `W/"`) {
+		t.Errorf("ETag of a layer without tile IDs: %s, want a weak one", etag)
+	}
+}
+
+func TestETagMatches(t *testing.T) {
+	tests := []struct {
+		ifNoneMatch, etag string
+		want              bool
+	}{
+		{`"abc"`, `"abc"`, true},
+		{`W/"abc"`, `"abc"`, true},
+		{`"abc"`, `W/"abc"`, true},
+		{`"x", "abc" `, `"abc"`, true},
+		{`*`, `"abc"`, true},
+		{`"abcd"`, `"abc"`, false},
+		{`abc`, `"abc"`, false},
+		{``, `"abc"`, false},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(http.MethodGet, "/", nil)
+		if tt.ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", tt.ifNoneMatch)
+		}
+		if got := etagMatches(req, tt.etag); got != tt.want {
+			t.Errorf("etagMatches(%q, %q) = %v, want %v", tt.ifNoneMatch, tt.etag, got, tt.want)
+		}
+	}
+}
+
+// TestDecodedTileETag checks that tiles decoded for clients not accepting
+// their stored encoding get another weak ETag than the stored ones.
+func TestDecodedTileETag(t *testing.T) {
+	dir := t.TempDir()
+	writeTestMBTiles(t, filepath.Join(dir, "v.mbtiles"), map[string]string{"format": "pbf"},
+		map[[3]int][]byte{{0, 0, 0}: gzipBytes(t, []byte("\x1a\x05layer"))})
+	useDataDir(t, dir)
+	scanLayers()
+
+	var stored, decoded string
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		stored = serveTest(method, "/v/0/0/0.pbf", "Accept-Encoding: gzip").Header().Get("ETag")
+		decoded = serveTest(method, "/v/0/0/0.pbf").Header().Get("ETag")
+		if !strings.HasPrefix(stored, `W/"`) || decoded != strings.TrimSuffix(stored, `"`)+`-identity"` {
+			t.Errorf("%s: ETag of stored tile %s, of decoded tile %s", method, stored, decoded)
+		}
+	}
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		if resp := serveTest(method, "/v/0/0/0.pbf", "If-None-Match: "+stored); resp.Code != http.StatusOK {
+			t.Errorf("%s: decoded tile with If-None-Match of the stored one: status %d, want 200", method, resp.Code)
+		}
+		if resp := serveTest(method, "/v/0/0/0.pbf", "If-None-Match: "+decoded); resp.Code != http.StatusNotModified {
+			t.Errorf("%s: decoded tile with its If-None-Match: status %d, want 304", method, resp.Code)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// /events streams a "layers" Server-Sent Event with the ScanResult of every
+// scan that adds, updates or removes layers, limited to the layers the API
+// key of the subscriber may access.
+const (
+	maxEventSubscribers = 64
+	eventKeepAlive      = 15 * time.Second
+	// eventBuffer is the number of events kept for a slow subscriber, which
+	// is disconnected when it falls further behind.
+	eventBuffer = 16
+)
+
+// eventSubscribers maps the channel of each subscriber to its layerFilter.
+var eventSubscribers = struct {
+	mu   sync.Mutex
+	subs map[chan string]func(name string) bool
+	id   int64
+}{subs: make(map[chan string]func(name string) bool)}
+
+func publishLayerEvent(result ScanResult) {
+	if len(result.Added) == 0 && len(result.Updated) == 0 && len(result.Removed) == 0 {
+		return
+	}
+	eventSubscribers.mu.Lock()
+	defer eventSubscribers.mu.Unlock()
+	eventSubscribers.id++
+	for sub, allowed := range eventSubscribers.subs {
+		visible := result
+		if allowed != nil {
+			// Subscribers only learn of layers their key may access. Scan
+			// errors may name files of any layer, so they are left out.
+			visible = ScanResult{
+				Added:   filterLayerNames(result.Added, allowed),
+				Updated: filterLayerNames(result.Updated, allowed),
+				Removed: filterLayerNames(result.Removed, allowed),
+			}
+			if len(visible.Added) == 0 && len(visible.Updated) == 0 && len(visible.Removed) == 0 {
+				continue
+			}
+		}
+		data, err := json.Marshal(visible)
+		if err != nil {
+			continue
+		}
+		event := fmt.Sprintf("id: %d\nevent: layers\ndata: %s\n\n", eventSubscribers.id, data)
+		select {
+		case sub <- event:
+		default:
+			delete(eventSubscribers.subs, sub)
+			close(sub)
+		}
+	}
+}
+
+func subscribeEvents(allowed func(name string) bool) (chan string, bool) {
+	eventSubscribers.mu.Lock()
+	defer eventSubscribers.mu.Unlock()
+	if len(eventSubscribers.subs) >= maxEventSubscribers {
+		return nil, false
+	}
+	sub := make(chan string, eventBuffer)
+	eventSubscribers.subs[sub] = allowed
+	return sub, true
+}
+
+func unsubscribeEvents(sub chan string) {
+	eventSubscribers.mu.Lock()
+	defer eventSubscribers.mu.Unlock()
+	if _, ok := eventSubscribers.subs[sub]; ok {
+		delete(eventSubscribers.subs, sub)
+		close(sub)
+	}
+}
+
+func eventsResponse(resp http.ResponseWriter, req *http.Request) {
+	allowOrigin(resp, req)
+	flusher, ok := resp.(http.Flusher)
+	if !ok {
+		http.Error(resp, "streaming not supported", 500)
+		return
+	}
+	sub, ok := subscribeEvents(layerFilter(req))
+	if !ok {
+		resp.Header().Set("Retry-After", "10")
+		http.Error(resp, "too many event subscribers", http.StatusServiceUnavailable)
+		return
+	}
+	defer unsubscribeEvents(sub)
+	resp.Header().Set("Content-Type", "text/event-stream")
+	resp.Header().Set("Cache-Control", "no-cache")
+	resp.WriteHeader(http.StatusOK)
+	if req.Method == http.MethodHead {
+		return
+	}
+	fmt.Fprint(resp, ": connected\n\n")
+	flusher.Flush()
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event, ok := <-sub:
+			if !ok {
+				return
+			}
+			if _, err := fmt.Fprint(resp, event); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(resp, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-req.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"path/filepath"
+)
+
+// excludePatterns are glob patterns, as of filepath.Match, of layer files
+// that are never opened, such as files being written or staged. They are
+// matched against the path of a file relative to its data directory. Data
+// directories are not searched recursively, so that is the file name.
+var excludePatterns []string
+
+// excludedCounts holds the number of excluded files per data directory of
+// the previous scan, which is logged only on change. It is guarded by scanMu.
+var excludedCounts = make(map[string]int)
+
+func parseExclude(pattern string) error {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return err
+	}
+	excludePatterns = append(excludePatterns, pattern)
+	return nil
+}
+
+func isExcluded(rel string) bool {
+	for _, pattern := range excludePatterns {
+		if ok, _ := filepath.Match(pattern, rel); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func reportExcluded(dir string, n int) {
+	if excludedCounts[dir] == n {
+		return
+	}
+	excludedCounts[dir] = n
+	logDebug("Excluded %d files in \"%s\"", n, dir)
+}
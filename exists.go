@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+var existsMaxTiles int
+
+type tileCoord struct {
+	Z int `json:"z"`
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+// exists reports whether the tile is served, without reading its data. Like
+// queryTile, it reports false for zero-length tiles unless
+// -serve-empty-tiles is set, and errTileTooLarge for tiles over
+// -max-tile-bytes.
+func (layer *Layer) exists(ctx context.Context, x, y, z int) (bool, error) {
+	if layer.pmtiles != nil {
+		_, length, found, err := layer.pmtiles.find(x, y, z)
+		if !found || err != nil {
+			return false, err
+		}
+		return tileSizeAllowed(int64(length))
+	}
+	if layer.customReader() {
+		data, err := layer.tile(ctx, x, y, z)
+		return data != nil, err
+	}
+	if layer.index != nil && !layer.index.has(x, y, z) {
+		return false, nil
+	}
+	var found bool
+	err := layer.retryBusy(ctx, x, y, z, func() error {
+		var size sql.NullInt64
+		err := layer.existsStmt.QueryRowContext(ctx, z, x, y).Scan(&size)
+		if err == sql.ErrNoRows {
+			found, err = false, nil
+		} else if err == nil {
+			found, err = tileSizeAllowed(size.Int64)
+		}
+		return err
+	})
+	return found, err
+}
+
+// headTileResponse answers a HEAD tile request for a layer with a known
+// format using the existence query, without reading the tile data.
+func headTileResponse(resp http.ResponseWriter, req *http.Request, layer *Layer, name string, x, y, z int, etag string) {
+	found, err := layer.exists(req.Context(), x, y, z)
+	setDebugHeaders(resp, layer, layer.tileSource())
+	if err != nil && layer.fileDeleted(err) {
+		logTileDebug("Layer file deleted", name, z, x, y)
+		http.NotFound(resp, req)
+		return
+	}
+	if err != nil {
+		logTileError("Error checking tile", name, z, x, y, err)
+		tileErrorResponse(resp, err)
+		return
+	}
+	if !found {
+		logMissingTile(name, z, x, y)
+		http.NotFound(resp, req)
+		return
+	}
+	if layer.formatEncoding != "" {
+		resp.Header().Add("Vary", "Accept-Encoding")
+		if acceptsEncoding(req, layer.formatEncoding) {
+			resp.Header().Add("Content-Encoding", layer.formatEncoding)
+		} else if tileDecoders[layer.formatEncoding] == nil {
+			http.Error(resp, encodingNotAccepted(layer.formatEncoding), http.StatusNotAcceptable)
+			return
+		} else {
+			etag = decodedETag(etag)
+		}
+	}
+	resp.Header().Set("ETag", etag)
+	if etagMatches(req, etag) {
+		resp.WriteHeader(http.StatusNotModified)
+		return
+	}
+	resp.Header().Add("Content-Type", layer.formatType)
+	layer.dims.setHeaders(resp, layer.formatType, nil)
+	resp.Header().Set("Accept-Ranges", "bytes")
+	resp.WriteHeader(http.StatusOK)
+}
+
+// existsResponse answers POST /{layer}/exists with a JSON array of tile
+// coordinates by a JSON array of booleans telling which tiles are present.
+func existsResponse(resp http.ResponseWriter, req *http.Request) {
+	allowOrigin(resp, req)
+	urlFields := layerPathFields(req.URL.Path)
+	if len(urlFields) != 3 {
+		http.NotFound(resp, req)
+		return
+	}
+	layer := acquireRequestLayer(resp, req, urlFields[1])
+	if layer == nil {
+		return
+	}
+	defer layer.activeRequests.Done()
+	if !layer.valid {
+		http.Error(resp, "layer invalid", 500)
+		return
+	}
+	var coords []tileCoord
+	if err := json.NewDecoder(req.Body).Decode(&coords); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(resp, fmt.Sprintf("request body exceeds %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(resp, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(coords) > existsMaxTiles {
+		http.Error(resp, fmt.Sprintf("at most %d tiles per request", existsMaxTiles), http.StatusBadRequest)
+		return
+	}
+	result := make([]bool, len(coords))
+	for i, c := range coords {
+		stored, storedZ, ok := layer.storedTile(c.X, c.Y, c.Z)
+		if !ok {
+			continue
+		}
+		found, err := layer.exists(req.Context(), c.X, stored, storedZ)
+		if errors.Is(err, errTileTooLarge) {
+			// The tile route does not serve it either.
+			continue
+		}
+		if err != nil {
+			logTileError("Error checking tile", urlFields[1], c.Z, c.X, c.Y, err)
+			http.Error(resp, "", 500)
+			return
+		}
+		result[i] = found
+	}
+	writeJSON(resp, req, result)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestHeadMatchesGet checks that HEAD requests, answered without reading the
+// tile, get the status of GET requests.
+func TestHeadMatchesGet(t *testing.T) {
+	large := append(append([]byte{}, testPNG...), make([]byte, 64)...)
+	dir := t.TempDir()
+	writeTestMBTiles(t, filepath.Join(dir, "r.mbtiles"), map[string]string{"format": "png"},
+		map[[3]int][]byte{{0, 0, 0}: testPNG, {1, 0, 0}: {}, {1, 1, 0}: large})
+	useDataDir(t, dir)
+	scanLayers()
+	savedMax, savedExistsMax := maxTileBytes, existsMaxTiles
+	defer func() { maxTileBytes, existsMaxTiles = savedMax, savedExistsMax }()
+	maxTileBytes, existsMaxTiles = 16, 10
+	etag := serveTest(http.MethodGet, "/r/0/0/0.png").Header().Get("ETag")
+
+	tests := []struct {
+		path, ifNoneMatch string
+		want              int
+	}{
+		{"/r/0/0/0.png", "", http.StatusOK},
+		{"/r/0/0/0.png", etag, http.StatusNotModified},
+		{"/r/0/0/0.png", `W/"other"`, http.StatusOK},
+		{"/r/1/0/0.png", "", http.StatusNotFound},
+		{"/r/1/0/1.png", "", http.StatusNotFound},
+		{"/r/1/0/1.png", etag, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		var header []string
+		if tt.ifNoneMatch != "" {
+			header = append(header, "If-None-Match: "+tt.ifNoneMatch)
+		}
+		for _, method := range []string{http.MethodGet, http.MethodHead} {
+			if resp := serveTest(method, tt.path, header...); resp.Code != tt.want {
+				t.Errorf("%s %s If-None-Match %s: status %d, want %d", method, tt.path, tt.ifNoneMatch, resp.Code, tt.want)
+			}
+		}
+	}
+	get, head := serveTest(http.MethodGet, "/r/1/1/0.png"), serveTest(http.MethodHead, "/r/1/1/0.png")
+	if get.Code == http.StatusOK || head.Code != get.Code {
+		t.Errorf("tile over -max-tile-bytes: GET status %d, HEAD status %d", get.Code, head.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/r/exists", strings.NewReader(`[{"z":0,"x":0,"y":0},{"z":1,"x":0,"y":0},{"z":1,"x":1,"y":0}]`))
+	resp := httptest.NewRecorder()
+	route(resp, req)
+	var found []bool
+	if err := json.Unmarshal(resp.Body.Bytes(), &found); err != nil || !reflect.DeepEqual(found, []bool{true, false, false}) {
+		t.Errorf("exists: %s", resp.Body.Bytes())
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// fdRetryDelay is how long scans skip a file that could not be opened for
+// lack of file descriptors.
+const fdRetryDelay = 10 * time.Second
+
+// fdRetryAt holds when files that failed for lack of file descriptors may be
+// opened again. It is guarded by scanMu.
+var fdRetryAt = make(map[string]time.Time)
+
+// isFDExhausted reports whether opening filename failed because the process
+// ran out of file descriptors. SQLite reports that as a generic "unable to
+// open database file", so the file is opened once more to find the cause.
+func isFDExhausted(err error, filename string) bool {
+	if errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) {
+		return true
+	}
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) || sqliteErr.Code != sqlite3.ErrCantOpen {
+		return false
+	}
+	f, err := os.Open(filename)
+	if err == nil {
+		f.Close()
+		return false
+	}
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE)
+}
+
+// deferOutOfFiles logs that filename could not be opened for lack of file
+// descriptors and makes scans skip it until fdRetryDelay passes, instead of
+// registering an invalid layer. It is called with scanMu held.
+func deferOutOfFiles(filename string) {
+	log.Printf("Warning: out of file descriptors opening \"%s\", retrying in %s; raise the limit with ulimit -n, or close idle layers",
+		filename, fdRetryDelay)
+	fdRetryAt[filename] = time.Now().Add(fdRetryDelay)
+}
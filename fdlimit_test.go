@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+func TestIsFDExhausted(t *testing.T) {
+	existing := filepath.Join(t.TempDir(), "a.mbtiles")
+	if err := os.WriteFile(existing, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cantOpen := sqlite3.Error{Code: sqlite3.ErrCantOpen}
+	tests := []struct {
+		name     string
+		err      error
+		filename string
+		want     bool
+	}{
+		{"EMFILE", &os.PathError{Op: "open", Path: existing, Err: syscall.EMFILE}, existing, true},
+		{"wrapped ENFILE", fmt.Errorf("opening: %w", syscall.ENFILE), existing, true},
+		{"SQLite can't open an openable file", cantOpen, existing, false},
+		{"SQLite can't open a missing file", cantOpen, filepath.Join(t.TempDir(), "missing.mbtiles"), false},
+		{"SQLite corrupt", sqlite3.Error{Code: sqlite3.ErrCorrupt}, existing, false},
+		{"other error", errors.New("no such table: tiles"), existing, false},
+	}
+	for _, tt := range tests {
+		if got := isFDExhausted(tt.err, tt.filename); got != tt.want {
+			t.Errorf("%s: isFDExhausted = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestOpenLayerOutOfFiles makes opening a layer fail for lack of file
+// descriptors by lowering the limit to the descriptors already open.
+func TestOpenLayerOutOfFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.mbtiles")
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		t.Skip("no file descriptor limit:", err)
+	}
+	// Descriptors are allocated lowest first, so the number of a new one is
+	// the count of those open.
+	f, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inUse := f.Fd()
+	f.Close()
+	lowered := limit
+	lowered.Cur = uint64(inUse)
+	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &lowered); err != nil {
+		t.Skip("can not lower the file descriptor limit:", err)
+	}
+	scanMu.Lock()
+	_, err = openLayer("a", path, time.Time{}, 0, time.Time{})
+	retryAt, deferred := fdRetryAt[path]
+	scanMu.Unlock()
+	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		scanMu.Lock()
+		delete(fdRetryAt, path)
+		scanMu.Unlock()
+	}()
+	if err == nil {
+		t.Fatal("openLayer succeeded with no file descriptors left")
+	}
+	if !deferred || !retryAt.After(time.Now()) {
+		t.Errorf("file not deferred after running out of file descriptors")
+	}
+	startingRequests.RLock()
+	_, registered := layers["a"]
+	startingRequests.RUnlock()
+	if registered {
+		t.Errorf("layer registered after running out of file descriptors")
+	}
+}
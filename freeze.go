@@ -0,0 +1,39 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// frozen stops the periodic scan, reloads and closing or reopening layers
+// through the admin API from changing the layer registry, so that it stays
+// stable during a rolling restart. Tiles are still served from the layers
+// loaded when it was frozen.
+var frozen atomic.Bool
+
+func setFrozen(on bool) {
+	if frozen.Swap(on) != on {
+		if on {
+			log.Printf("Layer registry frozen")
+		} else {
+			log.Printf("Layer registry unfrozen")
+		}
+	}
+}
+
+// freezeResponse handles POST /admin/freeze?enabled=true|false. Without the
+// parameter the registry is frozen.
+func freezeResponse(resp http.ResponseWriter, req *http.Request) {
+	on := true
+	if v := req.URL.Query().Get("enabled"); v != "" {
+		var err error
+		if on, err = strconv.ParseBool(v); err != nil {
+			http.Error(resp, "invalid enabled value", http.StatusBadRequest)
+			return
+		}
+	}
+	setFrozen(on)
+	writeJSON(resp, req, map[string]bool{"frozen": on})
+}
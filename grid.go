@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// ZoomCount is the number of tiles stored at one zoom level.
+type ZoomCount struct {
+	Zoom  int   `json:"zoom"`
+	Tiles int64 `json:"tiles"`
+}
+
+// gridScans allows a single tile count at a time, as counting reads the whole
+// tiles table or directory.
+var gridScans = make(chan struct{}, 1)
+
+// gridStats caches tile counts of a layer. A layer is reopened when its file
+// changes, so counts stay valid for the lifetime of the Layer.
+type gridStats struct {
+	mu     sync.Mutex
+	counts []ZoomCount
+}
+
+func (layer *Layer) zoomCounts(ctx context.Context) ([]ZoomCount, error) {
+	if layer.pmtiles != nil {
+		return layer.pmtiles.zoomCounts()
+	}
+	columns := layer.config.Columns
+	rows, err := layer.conn.QueryContext(ctx, fmt.Sprintf("SELECT %s, COUNT(*) FROM %s GROUP BY 1 ORDER BY 1",
+		quoteIdent(columns.Zoom), columns.from()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := []ZoomCount{}
+	for rows.Next() {
+		var c ZoomCount
+		if err := rows.Scan(&c.Zoom, &c.Tiles); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
+
+// zoomCounts walks all directories of the archive. Run-length entries count
+// once per tile they cover, split by the zoom levels their range of tile IDs
+// spans.
+func (p *PMTiles) zoomCounts() ([]ZoomCount, error) {
+	tiles := make(map[int]int64)
+	err := p.walk(func(entry pmtilesEntry) {
+		countRun(tiles, entry.tileID, uint64(entry.runLength))
+	})
+	if err != nil {
+		return nil, err
+	}
+	counts := []ZoomCount{}
+	for z := 0; z <= 31; z++ {
+		if tiles[z] > 0 {
+			counts = append(counts, ZoomCount{z, tiles[z]})
+		}
+	}
+	return counts, nil
+}
+
+// countRun adds the tiles of the run of tile IDs [id, id+n) to the counts
+// per zoom level, without visiting each tile.
+func countRun(tiles map[int]int64, id, n uint64) {
+	end := id + n
+	for z := pmtilesZoom(id); id < end; z++ {
+		next := end
+		if z < 31 && pmtilesZoomStart(z+1) < end {
+			next = pmtilesZoomStart(z + 1)
+		}
+		tiles[z] += int64(next - id)
+		id = next
+	}
+}
+
+// walk calls fn for every tile entry of the archive, reading all leaf
+// directories.
+func (p *PMTiles) walk(fn func(entry pmtilesEntry)) error {
+	var walk func(entries []pmtilesEntry, depth int) error
+	walk = func(entries []pmtilesEntry, depth int) error {
+		for _, entry := range entries {
+			if entry.runLength == 0 {
+				if depth >= 3 {
+					return fmt.Errorf("directory nesting too deep")
+				}
+				leaf, err := p.readDirectory(p.header.leafOffset+entry.offset, uint64(entry.length))
+				if err != nil {
+					return err
+				}
+				if err := walk(leaf, depth+1); err != nil {
+					return err
+				}
+				continue
+			}
+			fn(entry)
+		}
+		return nil
+	}
+	return walk(p.root, 0)
+}
+
+// pmtilesZoom returns the zoom level of a tile ID.
+func pmtilesZoom(id uint64) int {
+	z := 0
+	for z < 31 && id >= pmtilesZoomStart(z+1) {
+		z++
+	}
+	return z
+}
+
+// pmtilesZoomStart returns the first tile ID of zoom level z, the number of
+// tiles in all lower levels.
+func pmtilesZoomStart(z int) uint64 {
+	return ((uint64(1) << (2 * uint(z))) - 1) / 3
+}
+
+func gridMetadataResponse(resp http.ResponseWriter, req *http.Request) {
+	urlFields := layerPathFields(req.URL.Path)
+	if len(urlFields) != 3 {
+		http.NotFound(resp, req)
+		return
+	}
+	name := urlFields[1]
+	layer := acquireRequestLayer(resp, req, name)
+	if layer == nil {
+		return
+	}
+	defer layer.activeRequests.Done()
+	if !layer.valid {
+		http.Error(resp, "layer invalid", 500)
+		return
+	}
+	layer.grid.mu.Lock()
+	defer layer.grid.mu.Unlock()
+	if layer.grid.counts == nil {
+		select {
+		case gridScans <- struct{}{}:
+		default:
+			resp.Header().Set("Retry-After", "1")
+			http.Error(resp, "tile count in progress", http.StatusTooManyRequests)
+			return
+		}
+		counts, err := layer.zoomCounts(req.Context())
+		<-gridScans
+		if err != nil {
+			if req.Context().Err() == nil {
+				log.Printf("Error counting tiles of layer \"%s\": %s", name, err)
+				http.Error(resp, "", 500)
+			}
+			return
+		}
+		layer.grid.counts = counts
+	}
+	writeJSON(resp, req, layer.grid.counts)
+}
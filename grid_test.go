@@ -0,0 +1,48 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCountRun(t *testing.T) {
+	tests := []struct {
+		id, n uint64
+		want  map[int]int64
+	}{
+		{0, 1, map[int]int64{0: 1}},
+		{0, 5, map[int]int64{0: 1, 1: 4}},
+		{3, 4, map[int]int64{1: 2, 2: 2}},
+		{1, 84, map[int]int64{1: 4, 2: 16, 3: 64}},
+		{21, 0, map[int]int64{}},
+		// All tiles of zoom levels 0 to 20, which would take long one by one.
+		{0, pmtilesZoomStart(21), func() map[int]int64 {
+			want := make(map[int]int64)
+			for z := 0; z <= 20; z++ {
+				want[z] = 1 << (2 * z)
+			}
+			return want
+		}()},
+	}
+	for _, tt := range tests {
+		got := make(map[int]int64)
+		countRun(got, tt.id, tt.n)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("countRun(%d, %d) = %v, want %v", tt.id, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestPMTilesZoom(t *testing.T) {
+	for z := 0; z <= 31; z++ {
+		start := pmtilesZoomStart(z)
+		if got := pmtilesZoom(start); got != z {
+			t.Errorf("pmtilesZoom(%d) = %d, want %d", start, got, z)
+		}
+		if z > 0 {
+			if got := pmtilesZoom(start - 1); got != z-1 {
+				t.Errorf("pmtilesZoom(%d) = %d, want %d", start-1, got, z-1)
+			}
+		}
+	}
+}
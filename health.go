@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+)
+
+// The deep health check of /healthz?deep=1 reads the schema table of the
+// SQLite layers, to catch a broken driver or unreadable files that the
+// liveness check can not see. Its result is reused for deepHealthTTL, so
+// frequent probes do not add load.
+const (
+	deepHealthTimeout = 2 * time.Second
+	deepHealthTTL     = 5 * time.Second
+)
+
+var deepHealth struct {
+	mu      sync.Mutex
+	checked time.Time
+	err     error
+}
+
+// checkDeepHealth reports nil if any SQLite layer answers a query. Without
+// SQLite layers an in-memory database is queried, to check the driver.
+func checkDeepHealth() error {
+	deepHealth.mu.Lock()
+	defer deepHealth.mu.Unlock()
+	if time.Since(deepHealth.checked) < deepHealthTTL {
+		return deepHealth.err
+	}
+	deepHealth.err = probeSQLite()
+	deepHealth.checked = time.Now()
+	return deepHealth.err
+}
+
+func probeSQLite() error {
+	ctx, cancel := context.WithTimeout(context.Background(), deepHealthTimeout)
+	defer cancel()
+	var err error
+	probed := false
+	for _, name := range sortedLayerNames() {
+		layer := acquireLayer(name)
+		if layer == nil {
+			continue
+		}
+		if layer.valid && layer.conn != nil {
+			probed = true
+			err = probeQuery(ctx, layer.conn, "SELECT 1 FROM sqlite_master LIMIT 1")
+		}
+		layer.activeRequests.Done()
+		if probed && err == nil {
+			return nil
+		}
+	}
+	if probed {
+		return err
+	}
+	db, err := sql.Open(sqliteDriver, ":memory:")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return probeQuery(ctx, db, "SELECT 1")
+}
+
+// probeQuery runs query, which must select at most one integer. Selecting no
+// row is fine, as the file was read all the same.
+func probeQuery(ctx context.Context, db *sql.DB, query string) error {
+	var one int
+	if err := db.QueryRowContext(ctx, query).Scan(&one); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		if ctx.Err() != nil {
+			return errors.New("SQLite query timed out")
+		}
+		return err
+	}
+	return nil
+}
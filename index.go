@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+)
+
+// A presence index lists the tiles of an mbtiles file, so that requests for
+// missing tiles of sparse files are answered without querying SQLite. It is
+// stored next to the file with an ".idx" suffix, e.g. "osm.mbtiles.idx":
+//
+//	"MBTIDX1\n"                 magic
+//	int64 mtime, int64 size     of the mbtiles file the index was built from
+//	uvarint count
+//	count uvarint deltas        of sorted tile IDs
+//
+// Tile IDs number tiles by TMS coordinates with pmtilesTileID.
+type presenceIndex struct {
+	ids []uint64
+}
+
+const presenceIndexMagic = "MBTIDX1\n"
+
+// buildIndexes writes missing or stale presence indexes when files are opened.
+var buildIndexes bool
+
+func indexPath(filename string) string {
+	return filename + ".idx"
+}
+
+func presenceIndexID(x, y, z int) (uint64, bool) {
+	if z < 0 || z > 31 || x < 0 || y < 0 || x >= 1<<uint(z) || y >= 1<<uint(z) {
+		return 0, false
+	}
+	return pmtilesTileID(uint8(z), uint32(x), uint32(y)), true
+}
+
+func (idx *presenceIndex) has(x, y, z int) bool {
+	id, ok := presenceIndexID(x, y, z)
+	if !ok {
+		return false
+	}
+	i := sort.Search(len(idx.ids), func(i int) bool { return idx.ids[i] >= id })
+	return i < len(idx.ids) && idx.ids[i] == id
+}
+
+// readPresenceIndex loads the index of filename. It returns nil without an
+// error if there is no index, and an error if it does not match the file.
+func readPresenceIndex(filename string, info os.FileInfo) (*presenceIndex, error) {
+	data, err := os.ReadFile(indexPath(filename))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	r := bytes.NewReader(data)
+	magic := make([]byte, len(presenceIndexMagic))
+	var mtime, size int64
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != presenceIndexMagic {
+		return nil, fmt.Errorf("not a presence index")
+	}
+	if err := binary.Read(r, binary.LittleEndian, &mtime); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return nil, err
+	}
+	if mtime != info.ModTime().UnixNano() || size != info.Size() {
+		return nil, fmt.Errorf("index is out of date")
+	}
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(r.Len()) {
+		return nil, fmt.Errorf("tile count %d exceeds index size", n)
+	}
+	idx := &presenceIndex{ids: make([]uint64, n)}
+	var id uint64
+	for i := range idx.ids {
+		delta, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		id += delta
+		idx.ids[i] = id
+	}
+	return idx, nil
+}
+
+// writePresenceIndex lists all tiles of the layer into its index file.
+func (layer *Layer) writePresenceIndex(filename string, info os.FileInfo) (*presenceIndex, error) {
+	c := layer.config.Columns
+	rows, err := layer.conn.Query(fmt.Sprintf("SELECT %s, %s, %s FROM %s", quoteIdent(c.Zoom), quoteIdent(c.Column), quoteIdent(c.Row), c.from()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	idx := &presenceIndex{}
+	for rows.Next() {
+		var z, x, y int
+		if err := rows.Scan(&z, &x, &y); err != nil {
+			return nil, err
+		}
+		if id, ok := presenceIndexID(x, y, z); ok {
+			idx.ids = append(idx.ids, id)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(idx.ids, func(i, j int) bool { return idx.ids[i] < idx.ids[j] })
+
+	tmp := indexPath(filename) + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(f)
+	w.WriteString(presenceIndexMagic)
+	binary.Write(w, binary.LittleEndian, info.ModTime().UnixNano())
+	binary.Write(w, binary.LittleEndian, info.Size())
+	buf := make([]byte, binary.MaxVarintLen64)
+	w.Write(buf[:binary.PutUvarint(buf, uint64(len(idx.ids)))])
+	var last uint64
+	for _, id := range idx.ids {
+		w.Write(buf[:binary.PutUvarint(buf, id-last)])
+		last = id
+	}
+	if err = w.Flush(); err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp, indexPath(filename))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	return idx, nil
+}
+
+// loadPresenceIndex sets up the presence index of an mbtiles layer, building
+// it with -build-indexes. Layers without a usable index query SQLite.
+func (layer *Layer) loadPresenceIndex(filename string) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return
+	}
+	layer.index, err = readPresenceIndex(filename, info)
+	if err != nil {
+		log.Printf("Warning: ignoring presence index of \"%s\": %s", filename, err)
+	}
+	if layer.index == nil && buildIndexes {
+		if layer.index, err = layer.writePresenceIndex(filename, info); err != nil {
+			log.Printf("Error writing presence index of \"%s\": %s", filename, err)
+		} else {
+			log.Printf("Wrote presence index of \"%s\" with %d tiles", filename, len(layer.index.ids))
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// LayerConfig holds per-layer settings read from an optional sidecar file
+// named after the tiles file with a ".json" suffix, e.g. "osm.mbtiles.json".
+type LayerConfig struct {
+	Columns TileColumns `json:"columns"`
+	// SRS is the projection of the tiles, "EPSG:3857" unless set. Only Web
+	// Mercator layers are served on the reprojecting /4326/ route.
+	SRS string `json:"srs"`
+	// Formats maps a tile URL extension, such as "pbf", to the table holding
+	// tiles of that format, for files storing several formats side by side.
+	// Tile URLs without a listed extension are served from Columns.
+	Formats map[string]TileColumns `json:"formats"`
+	// Zooms lists the inclusive zoom ranges served, e.g. [[5, 14]], for
+	// layers whose other zoom levels come from elsewhere. Empty serves all.
+	Zooms [][2]int `json:"zooms"`
+	// Rows maps TMS rows of tile URLs to the rows stored in the file, for
+	// tile sets with an unusual row origin.
+	Rows RowTransform `json:"rows"`
+	// Reader names the TileReader of the tiles, "standard" unless set.
+	Reader string `json:"reader"`
+	// MaxConcurrency overrides -layer-concurrency, -1 for no limit.
+	MaxConcurrency int `json:"max_concurrency"`
+	// ContentType is sent for all tiles of the layer instead of the type
+	// sniffed or derived from metadata, for payloads such as quantized mesh.
+	ContentType string `json:"contentType"`
+	// ZoomOffset is added to the zoom of tile URLs to get the stored zoom,
+	// for files whose zoom levels are numbered off by it.
+	ZoomOffset int `json:"zoomOffset"`
+	// ViewCenter, as [lon, lat], and ViewZoom override the center of the
+	// metadata as the initial view of viewers and in TileJSON.
+	ViewCenter *[2]float64 `json:"viewCenter"`
+	ViewZoom   *float64    `json:"viewZoom"`
+}
+
+func (c LayerConfig) validateView() error {
+	if v := c.ViewCenter; v != nil && (v[0] < -180 || v[0] > 180 || v[1] < -maxLatitude || v[1] > maxLatitude) {
+		return fmt.Errorf("viewCenter %g,%g is outside -180..180, -%g..%g", v[0], v[1], maxLatitude, maxLatitude)
+	}
+	if z := c.ViewZoom; z != nil && (*z < 0 || *z > 30) {
+		return fmt.Errorf("viewZoom %g is outside 0..30", *z)
+	}
+	return nil
+}
+
+// RowTransform flips rows within their zoom level and then adds Offset.
+type RowTransform struct {
+	Flip   bool `json:"flip"`
+	Offset int  `json:"offset"`
+}
+
+// storedRow returns the stored row of TMS row y at zoom z, and false if it
+// falls outside the zoom level.
+func (t RowTransform) storedRow(y, z int) (int, bool) {
+	if z < 0 || z > 30 {
+		return y, false
+	}
+	if t.Flip {
+		y = (1 << uint(z)) - 1 - y
+	}
+	y += t.Offset
+	return y, y >= 0 && y < 1<<uint(z)
+}
+
+// tmsRow is the inverse of storedRow: it returns the TMS row of a stored row.
+func (t RowTransform) tmsRow(stored, z int) int {
+	y := stored - t.Offset
+	if t.Flip {
+		y = (1 << uint(z)) - 1 - y
+	}
+	return y
+}
+
+// servesZoom reports whether tiles at zoom z are served.
+func (c LayerConfig) servesZoom(z int) bool {
+	if len(c.Zooms) == 0 {
+		return true
+	}
+	for _, r := range c.Zooms {
+		if z >= r[0] && z <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// TileColumns maps the standard tiles table and its columns to the names used
+// by the file, for mbtiles variants produced by non-standard tooling.
+type TileColumns struct {
+	Table  string `json:"table"`
+	Zoom   string `json:"zoom_level"`
+	Column string `json:"tile_column"`
+	Row    string `json:"tile_row"`
+	Data   string `json:"tile_data"`
+}
+
+var tilesTable = "tiles"
+
+func sidecarPath(filename string) string {
+	return filename + ".json"
+}
+
+func sidecarMtime(filename string) time.Time {
+	fi, err := os.Stat(sidecarPath(filename))
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
+func loadLayerConfig(filename string) (config LayerConfig, err error) {
+	data, err := os.ReadFile(sidecarPath(filename))
+	if err == nil {
+		if err = json.Unmarshal(data, &config); err == nil {
+			err = config.validateView()
+		}
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	if config.SRS == "" {
+		config.SRS = "EPSG:3857"
+	}
+	if config.Reader == "" {
+		config.Reader = "standard"
+	}
+	config.Columns.setDefaults(tilesTable)
+	for ext, columns := range config.Formats {
+		columns.setDefaults("")
+		config.Formats[ext] = columns
+	}
+	return
+}
+
+// setDefaults fills an unset table name with table and unset column names
+// with the standard ones.
+func (c *TileColumns) setDefaults(table string) {
+	if c.Table == "" {
+		c.Table = table
+	}
+	for _, col := range []struct {
+		value *string
+		name  string
+	}{{&c.Zoom, "zoom_level"}, {&c.Column, "tile_column"}, {&c.Row, "tile_row"}, {&c.Data, "tile_data"}} {
+		if *col.value == "" {
+			*col.value = col.name
+		}
+	}
+}
+
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// where returns a condition selecting a single tile by zoom, column and row.
+func (c TileColumns) where() string {
+	return fmt.Sprintf("%s=? AND %s=? AND %s=?", quoteIdent(c.Zoom), quoteIdent(c.Column), quoteIdent(c.Row))
+}
+
+// from returns the quoted name of the tiles table.
+func (c TileColumns) from() string {
+	return quoteIdent(c.Table)
+}
+
+func tableColumns(conn *sql.DB, table string) (map[string]bool, error) {
+	rows, err := conn.Query("PRAGMA table_info(" + quoteIdent(table) + ")")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk); err != nil {
+			return nil, err
+		}
+		columns[name] = true
+	}
+	return columns, rows.Err()
+}
+
+// validate checks that the tiles table and all mapped columns exist. A file
+// lacking the configured table but having the standard one falls back to it.
+func (c *TileColumns) validate(conn *sql.DB) error {
+	existing, err := tableColumns(conn, c.Table)
+	if err != nil {
+		return err
+	}
+	if len(existing) == 0 && c.Table != "tiles" {
+		if existing, err = tableColumns(conn, "tiles"); err != nil {
+			return err
+		}
+		if len(existing) > 0 {
+			c.Table = "tiles"
+		}
+	}
+	return c.check(existing)
+}
+
+// check verifies that existing, the columns of the table, include all mapped
+// columns.
+func (c *TileColumns) check(existing map[string]bool) error {
+	if len(existing) == 0 {
+		return fmt.Errorf("no table \"%s\"", c.Table)
+	}
+	for _, name := range []string{c.Zoom, c.Column, c.Row, c.Data} {
+		if !existing[name] {
+			return fmt.Errorf("table \"%s\" has no column \"%s\"", c.Table, name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// serveLayerIndex enables HTML pages at /{layer}/ and /{layer}/{z}/ with the
+// layer's metadata and a viewer showing it.
+var serveLayerIndex bool
+
+var layerIndexTemplate = template.Must(template.New("layer").Parse(`<!DOCTYPE html>
+<html>
+    <head>
+        <meta charset="utf-8" />
+        <title>{{.Name}}</title>
+        <style>
+            iframe { width: 100%; height: 60vh; border: 1px solid #ccc; }
+            td { padding: 0 1em 0 0; vertical-align: top; }
+        </style>
+    </head>
+    <body>
+        <h1>{{.Name}}</h1>
+        <p><a href="/list">All layers</a>, <a href="/{{.Name}}.json">TileJSON</a></p>
+        <iframe src="{{.Viewer}}"></iframe>
+        <table>
+        {{- range .Metadata}}
+            <tr><td>{{.Key}}</td><td>{{.Value}}</td></tr>
+        {{- end}}
+        </table>
+    </body>
+</html>
+`))
+
+type metadataRow struct {
+	Key, Value string
+}
+
+// layerIndexPath reports whether the path is /{layer}/ or /{layer}/{z}/ and
+// returns its parts. Tile URLs always have four segments and no trailing
+// slash, so they never match.
+func layerIndexPath(path string) (name string, z int, hasZoom bool, ok bool) {
+	fields := layerPathFields(path)
+	if fields[len(fields)-1] != "" || fields[1] == "" {
+		return "", 0, false, false
+	}
+	switch len(fields) {
+	case 3:
+		return fields[1], 0, false, true
+	case 4:
+		z, err := strconv.Atoi(fields[2])
+		if err != nil || z < 0 || z > 31 {
+			return "", 0, false, false
+		}
+		return fields[1], z, true, true
+	}
+	return "", 0, false, false
+}
+
+func layerIndexResponse(resp http.ResponseWriter, req *http.Request, name string, z int, hasZoom bool) {
+	layer := acquireRequestLayer(resp, req, name)
+	if layer == nil {
+		return
+	}
+	defer layer.activeRequests.Done()
+	if !layer.valid {
+		http.NotFound(resp, req)
+		return
+	}
+	rows := make([]metadataRow, 0, len(layer.metadata))
+	for key, value := range layer.metadata {
+		rows = append(rows, metadataRow{key, value})
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Key < rows[j].Key })
+	center := layer.center()
+	if hasZoom {
+		center[2] = float64(z)
+	}
+	viewer := fmt.Sprintf("/?layer=%s#%g/%g/%g", name, center[2], center[1], center[0])
+	resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+	layerIndexTemplate.Execute(resp, struct {
+		Name     string
+		Viewer   string
+		Metadata []metadataRow
+	}{name, viewer, rows})
+}
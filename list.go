@@ -0,0 +1,29 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+)
+
+var listTemplate = template.Must(template.New("list").Parse(`<!DOCTYPE html>
+<html>
+    <head>
+        <meta charset="utf-8" />
+        <title>Layers</title>
+    </head>
+    <body>
+        <ul>
+        {{- range .}}
+            <li>{{.}}: <a href="/?layer={{.}}">viewer</a>, <a href="/{{.}}.json">TileJSON</a>, <a href="/{{.}}/metadata.json">metadata</a></li>
+        {{- else}}
+            <li>No layers</li>
+        {{- end}}
+        </ul>
+    </body>
+</html>
+`))
+
+func listResponse(resp http.ResponseWriter, req *http.Request) {
+	resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+	listTemplate.Execute(resp, filterLayerNames(sortedLayerNames(), layerFilter(req)))
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// jsonLogger is set when -log-json is enabled. Plain log.Printf output is
+// routed through it as well.
+var jsonLogger *slog.Logger
+var logLevel = new(slog.LevelVar)
+var logMissing bool
+
+// slowThreshold enables logging of tile reads taking longer than it.
+var slowThreshold time.Duration
+
+func setupJSONLogging() {
+	jsonLogger = slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel}))
+	slog.SetDefault(jsonLogger)
+}
+
+// quietLifecycle moves messages about layers being loaded, updated, removed
+// and disposed to debug level, for deployments with many frequently updated
+// layers. Errors are logged as usual.
+var quietLifecycle bool
+
+func logLifecycle(format string, args ...any) {
+	if !quietLifecycle {
+		log.Printf(format, args...)
+		return
+	}
+	logDebug(format, args...)
+}
+
+func logDebug(format string, args ...any) {
+	if logLevel.Level() > slog.LevelDebug {
+		return
+	}
+	if jsonLogger != nil {
+		jsonLogger.Debug(fmt.Sprintf(format, args...))
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// logTileError logs a failure to read or send a tile. Tiles exceeding
+// -max-tile-bytes are logged as a warning, as the file rather than the
+// server is at fault.
+func logTileError(msg, layer string, z, x, y int, err error) {
+	if errors.Is(err, errTileTooLarge) {
+		if jsonLogger != nil {
+			jsonLogger.Warn("Tile exceeds -max-tile-bytes", "layer", layer, "z", z, "x", x, "y", y)
+			return
+		}
+		log.Printf("Warning: tile of layer \"%s\" z=%d x=%d y=%d exceeds -max-tile-bytes", layer, z, x, y)
+		return
+	}
+	if jsonLogger != nil {
+		jsonLogger.Error(msg, "layer", layer, "z", z, "x", x, "y", y, "error", err.Error())
+		return
+	}
+	log.Printf("%s from layer \"%s\" z=%d x=%d y=%d: %v", msg, layer, z, x, y, err)
+}
+
+func logTileDebug(msg, layer string, z, x, y int) {
+	if logLevel.Level() > slog.LevelDebug {
+		return
+	}
+	if jsonLogger != nil {
+		jsonLogger.Debug(msg, "layer", layer, "z", z, "x", x, "y", y)
+		return
+	}
+	log.Printf("%s in layer \"%s\" z=%d x=%d y=%d", msg, layer, z, x, y)
+}
+
+// logMissingTile logs a request for a tile that does not exist if
+// -log-missing is set. It does not depend on the log level, so that the flag
+// enables no other messages.
+func logMissingTile(layer string, z, x, y int) {
+	if !logMissing {
+		return
+	}
+	if jsonLogger != nil {
+		jsonLogger.Info("Tile not found", "layer", layer, "z", z, "x", x, "y", y)
+		return
+	}
+	log.Printf("Tile not found in layer \"%s\" z=%d x=%d y=%d", layer, z, x, y)
+}
+
+func logSlowTile(layer string, z, x, y int, elapsed time.Duration) {
+	if slowThreshold <= 0 || elapsed < slowThreshold || logLevel.Level() > slog.LevelWarn {
+		return
+	}
+	if jsonLogger != nil {
+		jsonLogger.Warn("Slow tile read", "layer", layer, "z", z, "x", x, "y", y, "duration", elapsed.String())
+		return
+	}
+	log.Printf("Slow tile read in layer \"%s\" z=%d x=%d y=%d: %s", layer, z, x, y, elapsed)
+}
+
+// Tile responses that could not be sent completely, counted apart from read
+// errors of layers. clientAborts are those cut short by the client closing
+// the connection.
+var (
+	clientAborts atomic.Int64
+	writeErrors  atomic.Int64
+)
+
+// writeErrorRecorder keeps the first error of writing the response body,
+// which http.ServeContent does not return.
+type writeErrorRecorder struct {
+	http.ResponseWriter
+	err error
+}
+
+func (w *writeErrorRecorder) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	return n, err
+}
+
+// ReadFrom lets copies from files still use sendfile.
+func (w *writeErrorRecorder) ReadFrom(r io.Reader) (int64, error) {
+	n, err := io.Copy(w.ResponseWriter, r)
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	return n, err
+}
+
+func (w *writeErrorRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// logWriteError logs a failure to send a tile. Disconnected clients are
+// common and only logged at debug level.
+func logWriteError(layer string, z, x, y int, err error) {
+	if err == nil {
+		return
+	}
+	if errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET) {
+		clientAborts.Add(1)
+		logTileDebug("Client disconnected while sending tile", layer, z, x, y)
+		return
+	}
+	writeErrors.Add(1)
+	logTileError("Error sending tile", layer, z, x, y, err)
+}
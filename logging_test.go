@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestLogMissing checks that -log-missing logs missing tiles and nothing
+// else of debug level, such as lifecycle messages with -quiet-lifecycle.
+func TestLogMissing(t *testing.T) {
+	savedMissing, savedQuiet := logMissing, quietLifecycle
+	defer func() { logMissing, quietLifecycle = savedMissing, savedQuiet }()
+	logMissing, quietLifecycle = true, true
+	var out bytes.Buffer
+	saved := log.Writer()
+	log.SetOutput(&out)
+	defer log.SetOutput(saved)
+
+	dir := t.TempDir()
+	writeTestMBTiles(t, filepath.Join(dir, "r.mbtiles"), map[string]string{"format": "png"},
+		map[[3]int][]byte{{0, 0, 0}: testPNG})
+	useDataDir(t, dir)
+	scanLayers()
+	serveTest(http.MethodGet, "/r/0/0/0.png")
+	serveTest(http.MethodGet, "/r/1/0/0.png")
+
+	logged := out.String()
+	if !strings.Contains(logged, `Tile not found in layer "r" z=1 x=0 y=0`) {
+		t.Errorf("missing tile not logged: %q", logged)
+	}
+	if strings.Contains(logged, "Loaded file") {
+		t.Errorf("lifecycle message logged with -quiet-lifecycle: %q", logged)
+	}
+}
@@ -1,18 +1,26 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
 )
 
 const (
@@ -28,33 +36,87 @@ const (
             body, html, #map {
              height: 100%%;
             }
+            #loading {
+             display: none; position: absolute; top: 10px; left: 50px; z-index: 1000;
+             padding: 2px 8px; background: white; border-radius: 4px; font: 12px sans-serif;
+            }
         </style>
 
         <script>
-            var layers = [%s];
+            var fallbackLayers = %s;
+            var defaultLayer = %s;
 
-            function setUpMap(){
+            function setUpMap(tilejsons){
                  map = new L.Map('map', {fadeAnimation: false});
                  baseMaps = {};
-                 for (i=0; i < layers.length; i++) {
-                    name = layers[i];
-                    url = "/" + name+ "/{z}/{x}/{y}";
-                    layer  = new L.TileLayer(url, {tms: true});
-                    baseMaps[name] = layer;
-                    if (i==0) {
+                 selected = 0;
+                 for (i=0; i < tilejsons.length; i++) {
+                    if (tilejsons[i].id == defaultLayer) {
+                        selected = i;
+                    }
+                 }
+                 for (i=0; i < tilejsons.length; i++) {
+                    tilejson = tilejsons[i];
+                    layer  = new L.TileLayer(tilejson.tiles[0], {
+                        tms: tilejson.scheme == "tms",
+                        attribution: tilejson.attribution || ""
+                    });
+                    layer.on('tileerror', retryWhileLoading);
+                    baseMaps[tilejson.id] = layer;
+                    if (i==selected) {
                         layer.addTo(map);
                     }
                  }
                  L.control.layers(baseMaps, {}, {collapsed: false}).addTo(map);
-                 map.setView([55, 36], 9);
+                 if (tilejsons.length && tilejsons[selected].center) {
+                    center = tilejsons[selected].center;
+                    map.setView([center[1], center[0]], center[2]);
+                 } else {
+                    map.setView([55, 36], 9);
+                 }
                  var hash = new L.Hash(map);
             }
 
-            window.onload = setUpMap;
+            // Tiles fail while their layer is being replaced on the server,
+            // which marks such responses with X-Layer-Loading. Show that and
+            // retry instead of leaving the tiles blank.
+            function retryWhileLoading(e) {
+                if (!window.fetch) {
+                    return;
+                }
+                fetch(e.url, {method: "HEAD"}).then(function(resp) {
+                    if (!resp.headers.get("X-Layer-Loading")) {
+                        return;
+                    }
+                    var indicator = document.getElementById("loading");
+                    indicator.style.display = "block";
+                    setTimeout(function() {
+                        indicator.style.display = "none";
+                        e.tile.src = e.url;
+                    }, 1000);
+                });
+            }
+
+            window.onload = function() {
+                var fallback = function() {
+                    setUpMap(fallbackLayers);
+                };
+                if (!window.fetch) {
+                    fallback();
+                    return;
+                }
+                fetch("/layers.json").then(function(resp) {
+                    if (!resp.ok) {
+                        throw new Error(resp.statusText);
+                    }
+                    return resp.json();
+                }).then(setUpMap, fallback);
+            };
         </script>
     </header>
     <body style="margin: 0">
         <div id="map"></div>
+        <div id="loading">Layer is loading&hellip;</div>
 
     </body>
 </html>
@@ -62,49 +124,363 @@ const (
 )
 
 type Layer struct {
+	name           string
+	path           string
+	dataFile       string
+	tempFile       string
 	conn           *sql.DB
+	pinConn        *sql.Conn
 	tileStmt       *sql.Stmt
+	existsStmt     *sql.Stmt
+	formatStmts    map[string]*sql.Stmt
+	retinaStmt     *sql.Stmt
+	tileIDStmt     *sql.Stmt
+	gridStmt       *sql.Stmt
+	gridDataStmt   *sql.Stmt
+	index          *presenceIndex
 	activeRequests sync.WaitGroup
 	mtime          time.Time
 	size           int64
+	configMtime    time.Time
+	config         LayerConfig
 	valid          bool
+	metadata       map[string]string
+	formatType     string
+	formatEncoding string
+	attribution    string
+	vectorLayers   json.RawMessage
+	lastAccess     atomic.Int64
+	pmtiles        *PMTiles
+	errMu          sync.Mutex
+	lastErr        error
+	lastErrTime    time.Time
+	grid           gridStats
+	coverage       coverageStats
+	dims           tileDims
+	slots          chan struct{}
+	reader         TileReader
 }
 
-func newLayer(filename string) (layer *Layer, err error) {
+func newLayer(name, filename string) (layer *Layer, err error) {
 	layer = new(Layer)
-	layer.conn, err = sql.Open("sqlite3", filename)
-	if err != nil {
-		layer.valid = false
-		return
+	layer.name = name
+	layer.path = filename
+	layer.dataFile = filename
+	if trimCompressedSuffix(filename) != filename {
+		if layer.dataFile, err = decompressLayerFile(filename); err != nil {
+			return
+		}
+		layer.tempFile = layer.dataFile
+	} else if localSnapshot && !pinnedLayers[name] {
+		if layer.dataFile, err = snapshotLayerFile(filename); err != nil {
+			return
+		}
+		layer.tempFile = layer.dataFile
+	}
+	if strings.HasSuffix(trimCompressedSuffix(filename), ".pmtiles") {
+		err = layer.openPMTiles(filename)
+	} else {
+		err = layer.openMBTiles(filename)
 	}
-	layer.conn.SetMaxOpenConns(5)
-	layer.conn.SetMaxIdleConns(5)
-	layer.tileStmt, err = layer.conn.Prepare("SELECT tile_data FROM tiles WHERE zoom_level=? AND tile_column=? AND tile_row=?")
 	if err != nil {
-		layer.conn.Close()
 		layer.valid = false
+		if layer.tempFile != "" {
+			removeTempFile(layer.tempFile)
+		}
 		return
 	}
+	if upstreamWriteBack && layer.pmtiles == nil && !layer.writesBack() {
+		log.Printf("Warning: tiles fetched from upstream are not stored in \"%s\", which is read from a decompressed copy", filename)
+	}
+	layer.attribution = encodeHeaderValue(layer.metadata["attribution"])
+	layer.makeSlots()
 	layer.activeRequests.Add(1)
 	layer.valid = true
 	go func() {
 		layer.activeRequests.Wait()
-		layer.tileStmt.Close()
-		layer.conn.Close()
-		log.Printf("Layer %s disposed", filename)
+		layer.close()
+		logLifecycle("Layer %s disposed", filename)
 	}()
 	return
 }
 
-func (layer *Layer) tile(x, y, z int) ([]byte, error) {
-	rows, err := layer.tileStmt.Query(z, x, y)
+func (layer *Layer) openMBTiles(filename string) (err error) {
+	if pinnedLayers[layer.name] {
+		layer.conn, layer.pinConn, err = pinDatabase(layer.dataFile, filename)
+	} else {
+		layer.conn, err = sql.Open(sqliteDriver, sqliteDSN(layer.dataFile))
+	}
+	if err != nil {
+		return
+	}
+	layer.conn.SetMaxOpenConns(5)
+	layer.conn.SetMaxIdleConns(5)
+	layer.conn.SetConnMaxLifetime(connMaxLifetime)
+	layer.config, err = loadLayerConfig(filename)
+	if err == nil {
+		err = layer.config.Columns.validate(layer.conn)
+	}
+	if err == nil {
+		if layer.reader = tileReaders[layer.config.Reader]; layer.reader == nil {
+			err = fmt.Errorf("unknown tile reader \"%s\"", layer.config.Reader)
+		}
+	}
+	if err != nil {
+		layer.closeConn()
+		return
+	}
+	if analyzeFiles && layer.pinConn == nil {
+		analyze(layer.conn, filename)
+	}
+	columns := layer.config.Columns
+	layer.tileStmt, err = layer.conn.Prepare(tileQuery(columns))
+	if err != nil {
+		layer.closeConn()
+		return
+	}
+	exists := "SELECT length(" + quoteIdent(columns.Data) + ") FROM " + columns.from() + " WHERE " + columns.where()
+	layer.existsStmt, err = layer.conn.Prepare(exists + " LIMIT 1")
+	if err != nil {
+		layer.tileStmt.Close()
+		layer.closeConn()
+		return
+	}
+	layer.prepareFormats(filename)
+	layer.prepareTileIDQuery()
+	layer.prepareGridQueries()
+	if !layer.customReader() {
+		layer.loadPresenceIndex(filename)
+	}
+	retina := layer.config.Columns
+	retina.Table = retinaTable
+	if layer.retinaStmt, err = layer.prepareTileQuery(retina); err != nil {
+		layer.retinaStmt = nil
+	}
+	layer.metadata, err = readMetadata(layer.conn)
+	if err != nil {
+		log.Printf("Error reading metadata from \"%s\": %s", filename, err)
+	}
+	layer.detectFormat()
+	layer.vectorLayers, err = parseVectorLayers(layer.metadata["json"])
+	if err != nil {
+		log.Printf("Warning: invalid \"json\" metadata in \"%s\": %s", filename, err)
+	}
+	return nil
+}
+
+// webpFormat is served instead of the layer's own tiles to clients listing
+// image/webp in their Accept header. Its tiles are read from the "webp"
+// format of the layer config or, without one, from a webpTable with the
+// standard columns if the file has it.
+const webpFormat = "webp"
+const webpTable = "tiles_webp"
+
+// prepareFormats prepares tile queries for the extra formats of the layer
+// config. Formats whose table or columns are missing are left out.
+func (layer *Layer) prepareFormats(filename string) {
+	layer.formatStmts = make(map[string]*sql.Stmt)
+	for ext, columns := range layer.config.Formats {
+		stmt, err := layer.prepareTileQuery(columns)
+		if err != nil {
+			log.Printf("Warning: ignoring format \"%s\" of \"%s\": %s", ext, filename, err)
+			continue
+		}
+		layer.formatStmts[ext] = stmt
+	}
+	if _, ok := layer.config.Formats[webpFormat]; !ok {
+		webp := TileColumns{Table: webpTable}
+		webp.setDefaults("")
+		if stmt, err := layer.prepareTileQuery(webp); err == nil {
+			layer.formatStmts[webpFormat] = stmt
+		}
+	}
+}
+
+// prepareTileQuery checks the table and columns of columns and prepares a
+// query of a single tile from them.
+func (layer *Layer) prepareTileQuery(columns TileColumns) (*sql.Stmt, error) {
+	existing, err := tableColumns(layer.conn, columns.Table)
+	if err == nil {
+		err = columns.check(existing)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return layer.conn.Prepare(tileQuery(columns))
+}
+
+// tileQuery selects the length and the data of a tile, as read by queryTile.
+// SQLite gets the length of a blob without reading it, so with
+// -max-tile-bytes the data of larger tiles is left out instead of being
+// copied into memory.
+func tileQuery(columns TileColumns) string {
+	return "SELECT " + tileDataColumns(columns) + " FROM " + columns.from() + " WHERE " + columns.where()
+}
+
+// tileDataColumns selects the length and the data of tiles for tileQuery and
+// region downloads, checked by tileSizeAllowed.
+func tileDataColumns(columns TileColumns) string {
+	data := quoteIdent(columns.Data)
+	selected := data
+	if maxTileBytes > 0 {
+		selected = fmt.Sprintf("CASE WHEN length(%s) <= %d THEN %s END", data, maxTileBytes, data)
+	}
+	return "length(" + data + "), " + selected
+}
+
+// tileSizeAllowed reports whether a tile of size bytes is served: it returns
+// false for zero-length tiles without -serve-empty-tiles and errTileTooLarge
+// for tiles over -max-tile-bytes.
+func tileSizeAllowed(size int64) (bool, error) {
+	if size == 0 && !serveEmptyTiles {
+		return false, nil
+	}
+	if maxTileBytes > 0 && size > maxTileBytes {
+		return false, errTileTooLarge
+	}
+	return true, nil
+}
+
+func (layer *Layer) close() {
+	var err error
+	if layer.pmtiles != nil {
+		err = layer.pmtiles.Close()
+	} else {
+		layer.tileStmt.Close()
+		layer.existsStmt.Close()
+		for _, stmt := range layer.formatStmts {
+			stmt.Close()
+		}
+		if layer.retinaStmt != nil {
+			layer.retinaStmt.Close()
+		}
+		if layer.tileIDStmt != nil {
+			layer.tileIDStmt.Close()
+		}
+		if layer.gridStmt != nil {
+			layer.gridStmt.Close()
+		}
+		if layer.gridDataStmt != nil {
+			layer.gridDataStmt.Close()
+		}
+		err = layer.closeConn()
+	}
+	if err != nil {
+		log.Printf("Error closing layer file \"%s\": %s", layer.path, err)
+	}
+	if layer.tempFile != "" {
+		removeTempFile(layer.tempFile)
+	}
+}
+
+func readMetadata(conn *sql.DB) (map[string]string, error) {
+	metadata := make(map[string]string)
+	rows, err := conn.Query("SELECT name, value FROM metadata")
+	if err != nil {
+		return metadata, err
+	}
 	defer rows.Close()
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return metadata, err
+		}
+		metadata[name] = value
+	}
+	return metadata, rows.Err()
+}
+
+// tile returns tile data, or nil if the tile does not exist. Queries of the
+// standard reader failing because the database is busy or locked are retried
+// up to busyRetries times.
+func (layer *Layer) tile(ctx context.Context, x, y, z int) (data []byte, err error) {
+	defer func() {
+		if !errors.Is(err, context.Canceled) {
+			layer.recordError(err)
+		}
+	}()
+	if layer.pmtiles != nil {
+		return layer.pmtiles.tile(x, y, z)
+	}
+	return layer.reader.ReadTile(ctx, layer, x, y, z)
+}
+
+// formatTile reads a tile from the table of one of the extra formats of the
+// layer config.
+func (layer *Layer) formatTile(ctx context.Context, format string, x, y, z int) (data []byte, err error) {
+	defer func() {
+		if !errors.Is(err, context.Canceled) {
+			layer.recordError(err)
+		}
+	}()
+	return layer.retryQuery(ctx, layer.formatStmts[format], x, y, z)
+}
+
+// retryQuery runs a tile query, retrying while the database is busy.
+func (layer *Layer) retryQuery(ctx context.Context, stmt *sql.Stmt, x, y, z int) ([]byte, error) {
+	var data []byte
+	err := layer.retryBusy(ctx, x, y, z, func() (err error) {
+		data, err = queryTile(ctx, stmt, x, y, z)
+		return
+	})
+	return data, err
+}
+
+// retryBusy runs query of the tile at x, y and z, retrying while the
+// database is busy.
+func (layer *Layer) retryBusy(ctx context.Context, x, y, z int, query func() error) error {
+	backoff := busyBackoff
+	for attempt := 0; ; attempt++ {
+		err := query()
+		if !isBusy(err) || attempt >= busyRetries {
+			return err
+		}
+		logTileDebug(fmt.Sprintf("Database busy (%v), retrying", err), layer.name, z, x, y)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// recordError remembers the last tile read error. A successful read clears it.
+func (layer *Layer) recordError(err error) {
+	layer.errMu.Lock()
+	defer layer.errMu.Unlock()
+	layer.lastErr = err
+	if err != nil {
+		layer.lastErrTime = time.Now()
+	}
+}
+
+func (layer *Layer) lastError() (error, time.Time) {
+	layer.errMu.Lock()
+	defer layer.errMu.Unlock()
+	return layer.lastErr, layer.lastErrTime
+}
+
+func isBusy(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && (sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked)
+}
+
+func queryTile(ctx context.Context, stmt *sql.Stmt, x, y, z int) ([]byte, error) {
+	rows, err := stmt.QueryContext(ctx, z, x, y)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 	if rows.Next() {
+		var size sql.NullInt64
 		var buf []byte
-		rows.Scan(&buf)
+		if err := rows.Scan(&size, &buf); err != nil {
+			return nil, err
+		}
+		if ok, err := tileSizeAllowed(size.Int64); !ok {
+			return nil, err
+		}
 		return buf, nil
 	} else {
 		err = rows.Err()
@@ -113,136 +489,977 @@ func (layer *Layer) tile(x, y, z int) ([]byte, error) {
 }
 
 var layers = make(map[string]*Layer)
+
+// closedLayers maps names of layers closed through the admin API to their
+// files. It is guarded by startingRequests.
+var closedLayers = make(map[string]string)
+
+// loadingLayers holds the names of layers whose files are being opened by
+// openLayer, until the new layer is swapped in. Tile responses for them carry
+// an X-Layer-Loading header. It is guarded by startingRequests.
+var loadingLayers = make(map[string]bool)
 var startingRequests sync.RWMutex
+var watermark *Watermark
+var tileCache *TileCache
+
+// dataDir is where *.mbtiles files are looked for. If singleName is not
+// empty, dataDir is a single mbtiles file served under that name.
+var dataDir string
+var singleName string
+var scanMu sync.Mutex
+var scanWorkers = 8
 
-func updateLayers(dataDir *string) {
+type ScanResult struct {
+	Added   []string `json:"added"`
+	Updated []string `json:"updated"`
+	Removed []string `json:"removed"`
+	// Error is set when the data directory or some files could not be read.
+	// Layers are not removed by such a scan.
+	Error string `json:"error,omitempty"`
+}
+
+func updateLayers() {
 	for {
-		files, _ := filepath.Glob(filepath.Join(*dataDir, "*.mbtiles"))
-		seenLayers := make(map[string]bool)
-		for _, path := range files {
-			fi, err := os.Stat(path)
-			if err != nil || fi.IsDir() {
+		if !frozen.Load() {
+			start := time.Now()
+			result := scanLayers()
+			recordScan(time.Since(start), result)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// scanLayers brings the layer registry in sync with the files in dataDir and
+// the tenant directories.
+func scanLayers() ScanResult {
+	scanMu.Lock()
+	defer scanMu.Unlock()
+	result := ScanResult{Added: []string{}, Updated: []string{}, Removed: []string{}}
+	seenLayers := make(map[string]bool)
+	conflicts := make(map[string]bool)
+	// failed holds the prefixes of the sources that could not be scanned.
+	failed := make(map[string]bool)
+	var scanErr error
+	for _, source := range layerSources() {
+		if err := scanSource(source, seenLayers, conflicts, &result); err != nil {
+			failed[source.prefix] = true
+			if scanErr == nil {
+				scanErr = err
+			}
+		}
+	}
+	reportedConflicts = conflicts
+	reportScanError(scanErr)
+	if scanErr != nil {
+		result.Error = scanErr.Error()
+	}
+	for name, layer := range layers {
+		if failed[layerPrefix(name)] {
+			continue
+		}
+		if _, ok := seenLayers[name]; !ok && layer.valid {
+			startingRequests.Lock()
+			delete(layers, name)
+			layer.activeRequests.Done()
+			startingRequests.Unlock()
+			result.Removed = append(result.Removed, name)
+			logLifecycle("Layer \"%s\" removed", name)
+		}
+	}
+	startingRequests.Lock()
+	for name := range closedLayers {
+		if !seenLayers[name] && !failed[layerPrefix(name)] {
+			delete(closedLayers, name)
+		}
+	}
+	startingRequests.Unlock()
+	publishLayerEvent(result)
+	return result
+}
+
+// scanSource opens the new and changed layer files of a directory and marks
+// their layers in seenLayers. If the directory or some of its files can not
+// be read, it returns the error and the layers of the source are kept, as
+// the failure may be temporary; only their updates are missed.
+func scanSource(source layerSource, seenLayers, conflicts map[string]bool, result *ScanResult) error {
+	var files []string
+	var scanErr error
+	if singleName != "" {
+		files = []string{source.dir}
+	} else {
+		files, scanErr = listLayerFiles(source.dir)
+	}
+	var found []fileStat
+	for _, file := range statFiles(files) {
+		if file.err == nil && !file.info.IsDir() {
+			found = append(found, file)
+		} else if file.err != nil && !os.IsNotExist(file.err) && scanErr == nil {
+			scanErr = file.err
+		}
+	}
+	if scanErr != nil && (singleName != "" || len(files) == 0) {
+		return scanErr
+	}
+	for _, file := range resolveConflicts(found, source.prefix, conflicts) {
+		path, configMtime := file.path, file.configMtime
+		mtime, size := file.info.ModTime(), file.info.Size()
+		rawName, name := file.rawName, file.name
+		seenLayers[name] = true
+		if isClosedLayer(name) {
+			continue
+		}
+		oldLayer, layerExists := layers[name]
+		if !layerExists || oldLayer.mtime != mtime || oldLayer.size != size || oldLayer.configMtime != configMtime {
+			if time.Now().Before(fdRetryAt[path]) {
 				continue
 			}
-			mtime, size := fi.ModTime(), fi.Size()
-			name := filepath.Base(path)
-			name = strings.TrimSuffix(name, ".mbtiles")
-			seenLayers[name] = true
-			oldLayer, layerExists := layers[name]
-			if !layerExists || oldLayer.mtime != mtime || oldLayer.size != size {
-				layer, err := newLayer(path)
-				layer.mtime = mtime
-				layer.size = size
-				if err != nil {
-					log.Printf("Error opening mbtiles file \"%s\": %s", path, err)
-				}
-				layers[name] = layer
-				if layerExists && oldLayer.valid {
-					startingRequests.Lock()
-					oldLayer.activeRequests.Done()
-					startingRequests.Unlock()
-					log.Printf("Updated file \"%s\" as \"%s\"", path, name)
-				} else {
-					log.Printf("Loaded file \"%s\" as \"%s\"", path, name)
+			replaced, err := openLayer(name, path, mtime, size, configMtime)
+			if err != nil {
+				continue
+			}
+			if replaced {
+				result.Updated = append(result.Updated, name)
+				logLifecycle("Updated file \"%s\" as \"%s\"", path, name)
+			} else {
+				result.Added = append(result.Added, name)
+				logLifecycle("Loaded file \"%s\" as \"%s\"", path, name)
+				if safe := sanitizeLayerName(rawName); safe != rawName {
+					log.Printf("Layer name \"%s\" contains unsafe characters, renamed to \"%s\"", rawName, safe)
 				}
 			}
 		}
-		for name, layer := range layers {
-			if _, ok := seenLayers[name]; !ok && layer.valid {
-				startingRequests.Lock()
-				delete(layers, name)
-				layer.activeRequests.Done()
-				startingRequests.Unlock()
-				log.Printf("Layer \"%s\" removed", name)
+	}
+	return scanErr
+}
+
+type fileStat struct {
+	path        string
+	info        os.FileInfo
+	err         error
+	configMtime time.Time
+	// rawName is the layer name derived from the file name, and name is the
+	// sanitized name the layer is served under.
+	rawName, name string
+}
+
+// listLayerFiles returns the mbtiles files of dir followed by its pmtiles
+// files, each sorted by name and including compressed but not excluded ones.
+// Unlike filepath.Glob it reports read errors, so that an unreadable directory
+// is not taken for an empty one.
+func listLayerFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	excluded := 0
+	for _, ext := range []string{".mbtiles", ".pmtiles"} {
+		for _, entry := range entries {
+			if !strings.HasSuffix(trimCompressedSuffix(entry.Name()), ext) {
+				continue
+			}
+			if isExcluded(entry.Name()) {
+				excluded++
+				continue
 			}
+			files = append(files, filepath.Join(dir, entry.Name()))
 		}
-		time.Sleep(time.Second)
 	}
+	reportExcluded(dir, excluded)
+	return files, nil
+}
+
+// lastScanError is the error of the previous scan, logged only on change.
+// It is guarded by scanMu.
+var lastScanError string
+
+func reportScanError(err error) {
+	msg := ""
+	if err != nil {
+		msg = err.Error()
+	}
+	if msg == lastScanError {
+		return
+	}
+	if err != nil {
+		log.Printf("Error scanning layer files, keeping existing layers: %s", err)
+	} else if lastScanError != "" {
+		log.Printf("Scanning layer files works again")
+	}
+	lastScanError = msg
+}
 
+// statFiles stats files and their sidecars using up to scanWorkers
+// goroutines, which matters on slow network filesystems. Results are in the
+// order of files.
+func statFiles(files []string) []fileStat {
+	stats := make([]fileStat, len(files))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < scanWorkers && w < len(files); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				stats[i].path = files[i]
+				stats[i].info, stats[i].err = os.Stat(files[i])
+				if stats[i].err == nil {
+					stats[i].configMtime = sidecarMtime(files[i])
+				}
+			}
+		}()
+	}
+	for i := range files {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return stats
+}
+
+// sanitizeLayerName replaces every character of name except letters, digits,
+// '.', '-' and '_' with '_', as names end up in URLs, HTML and scripts of the
+// viewer.
+func sanitizeLayerName(name string) string {
+	safe := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '.' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+	if safe == "" || strings.Trim(safe, ".") == "" {
+		safe = "_" + safe
+	}
+	return safe
+}
+
+// openLayer opens path and registers it as layer name, disposing the layer it
+// replaces. It reports whether a valid layer was replaced. Callers must hold
+// scanMu.
+func openLayer(name, path string, mtime time.Time, size int64, configMtime time.Time) (bool, error) {
+	setLayerLoading(name, true)
+	layer, err := newLayer(name, path)
+	if err != nil && isFDExhausted(err, path) {
+		setLayerLoading(name, false)
+		deferOutOfFiles(path)
+		return false, err
+	}
+	delete(fdRetryAt, path)
+	layer.mtime = mtime
+	layer.size = size
+	layer.configMtime = configMtime
+	if err != nil {
+		log.Printf("Error opening mbtiles file \"%s\": %s", path, err)
+	}
+	startingRequests.Lock()
+	defer startingRequests.Unlock()
+	oldLayer, layerExists := layers[name]
+	layers[name] = layer
+	registerNameSegments(name)
+	delete(closedLayers, name)
+	delete(loadingLayers, name)
+	if layerExists && oldLayer.valid {
+		oldLayer.activeRequests.Done()
+		return true, nil
+	}
+	return false, nil
+}
+
+// closeLayer disposes a layer once its active requests finish. The layer is
+// opened again by the next request for it.
+func closeLayer(name string) bool {
+	scanMu.Lock()
+	defer scanMu.Unlock()
+	startingRequests.Lock()
+	defer startingRequests.Unlock()
+	layer, ok := layers[name]
+	if !ok {
+		return false
+	}
+	delete(layers, name)
+	closedLayers[name] = layer.path
+	if layer.valid {
+		layer.activeRequests.Done()
+	}
+	log.Printf("Layer \"%s\" closed", name)
+	return true
+}
+
+func setLayerLoading(name string, loading bool) {
+	startingRequests.Lock()
+	defer startingRequests.Unlock()
+	if loading {
+		loadingLayers[name] = true
+	} else {
+		delete(loadingLayers, name)
+	}
+}
+
+func isLayerLoading(name string) bool {
+	startingRequests.RLock()
+	defer startingRequests.RUnlock()
+	return loadingLayers[name]
+}
+
+func isClosedLayer(name string) bool {
+	startingRequests.RLock()
+	defer startingRequests.RUnlock()
+	_, ok := closedLayers[name]
+	return ok
+}
+
+// reopenLayer opens a layer closed through the admin API again, unless the
+// registry is frozen.
+func reopenLayer(name string) bool {
+	if frozen.Load() {
+		return false
+	}
+	scanMu.Lock()
+	defer scanMu.Unlock()
+	startingRequests.RLock()
+	path, ok := closedLayers[name]
+	startingRequests.RUnlock()
+	if !ok {
+		return false
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	if _, err := openLayer(name, path, fi.ModTime(), fi.Size(), sidecarMtime(path)); err != nil {
+		return false
+	}
+	log.Printf("Reopened file \"%s\" as \"%s\"", path, name)
+	return true
+}
+
+// acquireLayer looks up a layer by name and registers an active request on it,
+// so it is not disposed until the caller calls activeRequests.Done().
+func acquireLayer(name string) *Layer {
+	layer, closed := lookupLayer(name)
+	if layer == nil && closed && reopenLayer(name) {
+		layer, _ = lookupLayer(name)
+	}
+	return layer
+}
+
+func lookupLayer(name string) (layer *Layer, closed bool) {
+	startingRequests.RLock()
+	defer startingRequests.RUnlock()
+	layer, ok := layers[name]
+	if !ok {
+		_, closed = closedLayers[name]
+		return nil, closed
+	}
+	layer.activeRequests.Add(1)
+	layer.lastAccess.Store(time.Now().UnixNano())
+	return layer, false
+}
+
+// coordOrder is the order of the coordinate segments of tile URLs, "zxy" or
+// "zyx".
+var coordOrder = "zxy"
+
+// parseTileCoords parses the zoom, column and row of a tile URL from its
+// segments in coordOrder. Values that are not integers, or overflow int, are
+// reported as an error, so that the client gets a 400 instead of a 404 meant
+// for tiles that do not exist.
+func parseTileCoords(zs, xs, ys string) (z, x, y int, err error) {
+	if coordOrder == "zyx" {
+		xs, ys = ys, xs
+	}
+	coords := []*int{&z, &x, &y}
+	for i, s := range []string{zs, xs, ys} {
+		if *coords[i], err = strconv.Atoi(s); err != nil {
+			return 0, 0, 0, fmt.Errorf("invalid tile coordinate \"%s\"", s)
+		}
+	}
+	return
+}
+
+// storedTile maps the row and zoom of a tile URL to those stored in the file.
+// It reports false for tiles outside the zooms and rows the layer serves.
+func (layer *Layer) storedTile(x, y, z int) (int, int, bool) {
+	if !layer.config.servesZoom(z) {
+		return y, z, false
+	}
+	if layer.config.Rows != (RowTransform{}) {
+		var ok bool
+		if y, ok = layer.config.Rows.storedRow(y, z); !ok {
+			return y, z, false
+		}
+	}
+	if layer.config.ZoomOffset != 0 {
+		// Columns and rows stay those of the requested zoom, so they are
+		// checked against it before the offset is applied.
+		if z < 0 || z > 30 || x < 0 || x >= 1<<uint(z) || y < 0 || y >= 1<<uint(z) {
+			return y, z, false
+		}
+		z += layer.config.ZoomOffset
+		if minZoom, maxZoom := layer.zoomRange(); z < minZoom || z > maxZoom {
+			return y, z, false
+		}
+	}
+	return y, z, true
 }
 
 func tileResponse(resp http.ResponseWriter, req *http.Request) {
-	resp.Header().Add("Access-Control-Allow-Origin", "*")
+	allowOrigin(resp, req)
 	url := req.URL.Path
-	urlFields := strings.Split(url, "/")
+	urlFields := layerPathFields(url)
 	if len(urlFields) != 5 {
 		http.NotFound(resp, req)
 		return
 	}
-	startingRequests.RLock()
-	layer, ok := layers[urlFields[1]]
-	if !ok {
-		startingRequests.RUnlock()
+	if !checkLayerAccess(resp, req, urlFields[1]) {
+		return
+	}
+	if isLayerLoading(urlFields[1]) {
+		resp.Header().Set("X-Layer-Loading", "1")
+	}
+	// Access is checked above, before the header tells of the layer.
+	layer := acquireLayer(urlFields[1])
+	if layer == nil {
 		http.NotFound(resp, req)
 		return
-	} else {
-		layer.activeRequests.Add(1)
-		defer func() {
-			layer.activeRequests.Done()
-		}()
-		startingRequests.RUnlock()
 	}
-	if layer.tileStmt == nil {
+	defer layer.activeRequests.Done()
+	if !layer.valid {
 		http.Error(resp, "layer invalid", 500)
 		return
 	}
-	z, err := strconv.Atoi(urlFields[2])
+	format := ""
+	if i := strings.LastIndexByte(urlFields[4], '.'); i >= 0 {
+		ext := urlFields[4][i+1:]
+		if layer.formatStmts[ext] != nil {
+			format = ext
+		} else if !layer.allowsExtension(ext) {
+			http.NotFound(resp, req)
+			return
+		}
+		urlFields[4] = urlFields[4][:i]
+	}
+	z, x, y, err := parseTileCoords(urlFields[2], urlFields[3], urlFields[4])
 	if err != nil {
-		http.NotFound(resp, req)
+		http.Error(resp, err.Error(), http.StatusBadRequest)
 		return
 	}
-	x, err := strconv.Atoi(urlFields[3])
-	if err != nil {
+	urlY, urlZ := y, z
+	var ok bool
+	if y, z, ok = layer.storedTile(x, y, z); !ok {
 		http.NotFound(resp, req)
 		return
 	}
-	y, err := strconv.Atoi(urlFields[4])
-	if err != nil {
+	if !layer.acquireSlot(req.Context()) {
+		resp.Header().Set("Retry-After", "1")
+		http.Error(resp, "layer busy", http.StatusServiceUnavailable)
+		return
+	}
+	defer layer.releaseSlot()
+	if attributionHeader && layer.attribution != "" {
+		resp.Header().Set("X-Attribution", layer.attribution)
+	}
+	if v := req.URL.Query().Get("scale"); v != "" && v != "1" {
+		if maxTileScale == 1 {
+			http.Error(resp, "scale is not supported by this server", http.StatusBadRequest)
+			return
+		}
+		scale, err := strconv.Atoi(v)
+		if err != nil || scale < 1 || scale > maxTileScale {
+			http.Error(resp, fmt.Sprintf("scale must be an integer from 1 to %d", maxTileScale), http.StatusBadRequest)
+			return
+		}
+		scaledTileResponse(resp, req, layer, urlFields[1], x, y, z, scale)
+		return
+	}
+	etag := layer.weakETag()
+	negotiated := false
+	if format == "" && layer.formatStmts[webpFormat] != nil {
+		resp.Header().Add("Vary", "Accept")
+		if acceptsType(req, formatContentTypes[webpFormat]) {
+			format, negotiated = webpFormat, true
+			etag = layer.variantETag(format)
+		}
+	}
+	if format == "" && watermark == nil && !hasTileProcessor() && layer.formatType != "" && !alwaysSniff {
+		// With tile IDs, conditional requests are answered without reading
+		// the tile.
+		if id, err := layer.tileETag(req.Context(), req, x, y, z); err == nil && id != "" {
+			etag = id
+			if etagMatches(req, etag) {
+				resp.Header().Set("ETag", etag)
+				resp.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+	}
+	// Both shortcuts answer 404 for tiles missing locally, so they are
+	// skipped when those are read from upstream.
+	if req.Method == http.MethodHead && upstream == "" && layer.formatType != "" && !alwaysSniff && format == "" && !hasTileProcessor() &&
+		(!tileDimensions || layer.dims.known()) {
+		headTileResponse(resp, req, layer, urlFields[1], x, y, z, etag)
+		return
+	}
+	if layer.pmtiles != nil && upstream == "" && watermark == nil && !hasTileProcessor() && layer.formatType != "" && !alwaysSniff &&
+		(layer.formatEncoding == "" || acceptsEncoding(req, layer.formatEncoding)) {
+		streamTileResponse(resp, req, layer, urlFields[1], x, y, z)
+		return
+	}
+	key := tileKey{layer, format, 1, x, y, z}
+	data, cachedType, cached := tileCache.get(key)
+	ctx := req.Context()
+	if tileTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, tileTimeout)
+		defer cancel()
+	}
+	if !cached {
+		start := time.Now()
+		if format != "" {
+			data, err = layer.formatTile(ctx, format, x, y, z)
+		}
+		if negotiated && data == nil && err == nil {
+			// Tiles missing from the WebP table fall back to the layer's own.
+			format, key.format, etag = "", "", layer.weakETag()
+		}
+		if format == "" {
+			data, err = layer.tile(ctx, x, y, z)
+		}
+		logSlowTile(urlFields[1], z, x, y, time.Since(start))
+	}
+	if cached {
+		setDebugHeaders(resp, layer, "cache")
+	} else {
+		setDebugHeaders(resp, layer, layer.tileSource())
+	}
+	if debugHeaders && tileCache != nil {
+		if cached {
+			resp.Header().Set("X-Cache", "HIT")
+		} else {
+			resp.Header().Set("X-Cache", "MISS")
+		}
+	}
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		logTileError("Timeout getting tile", urlFields[1], z, x, y, err)
+		http.Error(resp, "", http.StatusGatewayTimeout)
+		return
+	}
+	if err != nil && layer.fileDeleted(err) {
+		logTileDebug("Layer file deleted", urlFields[1], z, x, y)
 		http.NotFound(resp, req)
 		return
 	}
-	data, err := layer.tile(x, y, z)
 	if err != nil {
-		log.Printf("Error getting tile from layer \"%s\" z=%d x=%d y=%d: %v", urlFields[1], z, x, y, err)
-		http.Error(resp, "", 500)
+		logTileError("Error getting tile", urlFields[1], z, x, y, err)
+		tileErrorResponse(resp, err)
 		return
 	}
+	if data == nil && upstream != "" && format == "" {
+		data, err = layer.fetchUpstream(ctx, x, urlY, urlZ)
+		setDebugHeaders(resp, layer, "upstream")
+		if err != nil {
+			logTileError("Error fetching tile from upstream", urlFields[1], z, x, y, err)
+			http.Error(resp, "", http.StatusBadGateway)
+			return
+		}
+	}
 	if data == nil {
-		//fmt.Println("Tile not found")
+		logMissingTile(urlFields[1], z, x, y)
 		http.NotFound(resp, req)
 		return
 	} else {
-		resp.Header().Add("Content-Type", "image/png")
-		resp.Write(data)
+		contentType, encoding := layer.contentType(data)
+		if format != "" {
+			_, encoding = sniffTile(data)
+			contentType = formatContentTypes[format]
+			if contentType == "" {
+				contentType = "application/octet-stream"
+			}
+		}
+		if cached && cachedType != "" {
+			contentType = cachedType
+		} else if !cached && (watermark != nil || hasTileProcessor()) {
+			if watermark != nil {
+				data = watermark.apply(data)
+			}
+			if data, contentType, err = tileProcessor.Process(urlFields[1], z, x, y, contentType, data); err != nil {
+				logTileError("Error processing tile", urlFields[1], z, x, y, err)
+				http.Error(resp, "", 500)
+				return
+			}
+			tileCache.put(key, data, contentType)
+		}
+		if encoding != "" {
+			resp.Header().Add("Vary", "Accept-Encoding")
+			if acceptsEncoding(req, encoding) {
+				resp.Header().Add("Content-Encoding", encoding)
+			} else if decode := tileDecoders[encoding]; decode == nil {
+				http.Error(resp, encodingNotAccepted(encoding), http.StatusNotAcceptable)
+				return
+			} else if data, err = decode(data); err != nil {
+				logTileError("Error decompressing tile", urlFields[1], z, x, y, err)
+				http.Error(resp, "", 500)
+				return
+			} else {
+				etag = decodedETag(etag)
+			}
+		}
+		resp.Header().Add("Content-Type", contentType)
+		layer.dims.setHeaders(resp, contentType, bytes.NewReader(data))
+		resp.Header().Set("ETag", etag)
+		w := &writeErrorRecorder{ResponseWriter: resp}
+		http.ServeContent(w, req, "", layer.mtime, bytes.NewReader(data))
+		flushTile(resp)
+		logWriteError(urlFields[1], z, x, y, w.err)
+	}
+}
+
+var defaultLayer string
+var debugHeaders bool
+var tileTimeout time.Duration
+var attributionHeader bool
+var busyRetries int
+var maxTileBytes int64 = 16 << 20
+
+// flushTiles flushes tile responses as soon as they are written instead of
+// when net/http does after the handler returns. Only logging the write error
+// runs in between, so there is no measurable benefit: on loopback the median
+// latency of small tiles went from about 150us to 200-330us, for the extra
+// write call, which is why it is off by default.
+var flushTiles bool
+
+func flushTile(resp http.ResponseWriter) {
+	if f, ok := resp.(http.Flusher); ok && flushTiles {
+		f.Flush()
+	}
+}
+
+// serveEmptyTiles serves zero-length tiles as they are. By default they are
+// treated as missing, as some generators store them to mark "no data".
+var serveEmptyTiles bool
+
+var errTileTooLarge = errors.New("tile exceeds -max-tile-bytes")
+
+const busyBackoff = 10 * time.Millisecond
+
+// tileSource is the X-Tile-Source of tiles read from the file of the layer.
+func (layer *Layer) tileSource() string {
+	if layer.pmtiles != nil {
+		return "pmtiles"
+	}
+	return "sqlite"
+}
+
+func setDebugHeaders(resp http.ResponseWriter, layer *Layer, source string) {
+	if !debugHeaders {
+		return
 	}
+	resp.Header().Set("X-Tile-Source", source)
+	resp.Header().Set("X-Layer-Mtime", layer.mtime.UTC().Format(http.TimeFormat))
 }
 
 func viewer(resp http.ResponseWriter, req *http.Request) {
-	layersNames := make([]string, len(layers))
-	i := 0
-	for name := range layers {
-		layersNames[i] = "\"" + name + "\""
-		i++
+	// Fallback TileJSONs come from the same code as /layers.json, with
+	// relative tile URLs.
+	docs := layerTileJSONs(req, "")
+	wanted := req.URL.Query().Get("layer")
+	if wanted == "" {
+		wanted = defaultLayer
+	}
+	selected := ""
+	for _, doc := range docs {
+		if doc.ID == wanted {
+			selected = doc.ID
+		}
 	}
-	fmt.Fprintf(resp, html, strings.Join(layersNames, ","))
+	if selected == "" && len(docs) > 0 {
+		selected = docs[0].ID
+	}
+	docsJSON, _ := json.Marshal(docs)
+	selectedJSON, _ := json.Marshal(selected)
+	resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(resp, html, docsJSON, selectedJSON)
 }
 
 func route(resp http.ResponseWriter, req *http.Request) {
-	if req.URL.Path == "/" {
+	if !checkServerMethod(resp, req) {
+		return
+	}
+	if adminToken != "" && strings.HasPrefix(req.URL.Path, "/admin/") {
+		limitBody(resp, req)
+		adminRoute(resp, req)
+		return
+	}
+	if strings.HasSuffix(req.URL.Path, "/exists") {
+		if checkMethod(resp, req, routeMethods(req.URL.Path)) && !inMaintenance(resp) {
+			limitBody(resp, req)
+			existsResponse(resp, req)
+		}
+		return
+	}
+	if !checkMethod(resp, req, routeMethods(req.URL.Path)) {
+		return
+	}
+	if req.URL.Path == "/healthz" {
+		healthResponse(resp, req)
+	} else if req.URL.Path == "/" {
 		viewer(resp, req)
+	} else if req.URL.Path == "/list" {
+		listResponse(resp, req)
+	} else if req.URL.Path == "/layers.json" {
+		layersResponse(resp, req)
+	} else if req.URL.Path == "/catalog.json" {
+		catalogResponse(resp, req)
+	} else if req.URL.Path == "/events" {
+		eventsResponse(resp, req)
+	} else if serveMetrics && req.URL.Path == "/metrics" {
+		metricsResponse(resp, req)
+	} else if serveOpenAPI && req.URL.Path == "/openapi.json" {
+		openAPIResponse(resp, req)
+	} else if strings.HasSuffix(req.URL.Path, ".json") && len(layerPathFields(req.URL.Path)) == 2 {
+		tileJSONResponse(resp, req)
+	} else if inMaintenance(resp) {
+		// Routes below open layers, so they are not served during
+		// maintenance.
+		return
+	} else if strings.HasSuffix(req.URL.Path, "/metadata.json") && len(layerPathFields(req.URL.Path)) == 3 {
+		metadataResponse(resp, req)
+	} else if name, z, hasZoom, ok := layerIndexPath(req.URL.Path); serveLayerIndex && ok {
+		layerIndexResponse(resp, req, name, z, hasZoom)
+	} else if serveGeographic && strings.HasPrefix(req.URL.Path, "/4326/") {
+		geographicResponse(resp, req)
+	} else if debugHeaders && strings.HasSuffix(req.URL.Path, "/meta") {
+		tileMetaResponse(resp, req)
+	} else if strings.HasSuffix(req.URL.Path, gridSuffix) {
+		gridResponse(resp, req)
+	} else if strings.HasSuffix(req.URL.Path, "/coverage.geojson") {
+		coverageResponse(resp, req)
+	} else if strings.HasSuffix(req.URL.Path, "/grid-metadata") {
+		gridMetadataResponse(resp, req)
+	} else if strings.HasSuffix(req.URL.Path, "/region") {
+		regionResponse(resp, req)
+	} else if len(layerPathFields(req.URL.Path)) != 5 {
+		notFoundResponse(resp, req)
 	} else {
 		tileResponse(resp, req)
 	}
 
 }
 
+func isWildcardHost(host string) bool {
+	host = strings.Trim(host, "[]")
+	if host == "" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsUnspecified()
+}
+
 func main() {
 	port := flag.Int("port", 8080, "port to listen")
 	host := flag.String("host", "127.0.0.1", "address to bind to")
-	dataDir := flag.String("path", ".", "where to look for *.mbtiles files")
+	flag.StringVar(&dataDir, "path", ".", "where to look for *.mbtiles and *.pmtiles files, or a single file to serve")
+	flag.StringVar(&singleName, "name", "", "layer name when -path is a single file (default: file base name)")
+	watermarkFile := flag.String("watermark", "", "image to overlay on raster tiles")
+	watermarkPos := flag.String("watermark-pos", "bottom-right", "watermark corner: top-left, top-right, bottom-left or bottom-right")
+	cacheSize := flag.Int("cache-size", 1024, "number of processed tiles to keep in memory")
+	flag.IntVar(&maxTileScale, "max-scale", maxTileScale, "largest ?scale= factor of raster tiles, 1 to disable scaling")
+	flag.IntVar(&regionMaxTiles, "region-max-tiles", 10000, "maximum number of tiles in a region download")
+	flag.BoolVar(&alwaysSniff, "always-sniff", false, "detect content type of every tile instead of trusting layer metadata")
+	flag.Int64Var(&maxRequestBody, "max-request-body", maxRequestBody, "maximum size of POST request bodies in bytes, 0 for no limit")
+	flag.IntVar(&existsMaxTiles, "exists-max-tiles", 1000, "maximum number of tiles in an existence check request")
+	serverHeader := flag.String("server-header", "", "value of the Server response header, empty to omit it")
+	allowPublic := flag.Bool("allow-public", false, "allow binding to all interfaces without -api-keys when -require-allow-public is set")
+	requirePublicFlag := flag.Bool("require-allow-public", false, "refuse to bind to all interfaces without -api-keys unless -allow-public is passed")
+	flag.BoolVar(&serveLayerIndex, "layer-index", false, "serve HTML pages with metadata and a viewer at /{layer}/ and /{layer}/{z}/")
+	corsOriginList := flag.String("cors-origins", "", "comma-separated origins allowed by CORS, e.g. https://app.example.com,*.example.com (default: any)")
+	flag.BoolVar(&tileDimensions, "tile-dimensions", false, "add X-Tile-Width and X-Tile-Height headers read from PNG, JPEG and GIF tiles")
+	flag.Func("tenant", "serve the layers of a directory under a path prefix, as prefix=dir (repeatable)", parseTenant)
+	flag.Func("exclude", "skip layer files whose path relative to the data directory matches a glob pattern, e.g. *.part.mbtiles (repeatable)", parseExclude)
+	flag.Func("pin-layer", "copy the file of a layer into memory when it is opened (repeatable)", func(name string) error {
+		pinnedLayers[name] = true
+		return nil
+	})
+	flag.BoolVar(&localSnapshot, "local-snapshot", false, "read layers from a copy of their file in $TMPDIR, taken when the file is opened or changes")
+	flag.StringVar(&coordOrder, "coord-order", coordOrder, "order of the coordinates in tile URLs: zxy or zyx")
+	flag.StringVar(&slashMode, "slashes", slashMode, "handling of paths with trailing or doubled slashes: strict (as they are), serve (as the canonical path) or redirect (to it)")
+	flag.IntVar(&layerConcurrency, "layer-concurrency", 0, "maximum number of tile requests of a layer handled at once, 0 for no limit")
+	flag.DurationVar(&layerQueueTimeout, "layer-queue-timeout", layerQueueTimeout, "time a request over -layer-concurrency waits before it is answered with 503")
+	flag.StringVar(&defaultLayer, "default-layer", "", "layer initially shown in the viewer (default: first by name)")
+	flag.BoolVar(&debugHeaders, "debug-headers", false, "add X-Tile-Source, X-Layer-Mtime and X-Cache headers to tile responses")
+	flag.DurationVar(&tileTimeout, "tile-timeout", 0, "maximum time to spend looking up a tile, 0 for no limit")
+	flag.BoolVar(&flushTiles, "flush-tiles", false, "flush each tile response right after writing it, for latency over throughput")
+	flag.BoolVar(&attributionHeader, "attribution-header", false, "add layer attribution as X-Attribution header to tile responses")
+	logJSON := flag.Bool("log-json", false, "write logs as JSON records")
+	flag.BoolVar(&quietLifecycle, "quiet-lifecycle", false, "log layers being loaded, updated, removed and disposed at debug level only")
+	flag.BoolVar(&logMissing, "log-missing", false, "log requests for missing tiles")
+	flag.StringVar(&tilesTable, "tiles-table", tilesTable, "name of the table or view holding tiles")
+	flag.StringVar(&onConflict, "on-conflict", onConflict, "which file serves a layer name shared by several files: first, last, error (none) or suffix (all, later ones renamed)")
+	flag.IntVar(&scanWorkers, "scan-workers", scanWorkers, "number of parallel file stat calls when scanning for layers")
+	flag.BoolVar(&serveOpenAPI, "openapi", false, "serve an OpenAPI description of the endpoints at /openapi.json")
+	flag.IntVar(&gzipLevel, "gzip-level", gzipLevel, "gzip compression level of JSON and HTML responses, 1-9 or -1 for default")
+	flag.IntVar(&compressMinBytes, "compress-min-bytes", compressMinBytes, "smallest JSON or HTML response body compressed with gzip, 0 to compress all")
+	flag.BoolVar(&serveMetrics, "metrics", false, "serve Prometheus metrics at /metrics")
+	flag.StringVar(&adminToken, "admin-token", "", "bearer token enabling /admin/ endpoints")
+	flag.DurationVar(&maintenanceTimeout, "maintenance-timeout", 30*time.Minute, "time after which maintenance mode switches off, 0 to keep it on")
+	flag.DurationVar(&maintenanceRetryAfter, "maintenance-retry-after", time.Minute, "Retry-After sent while in maintenance mode")
+	flag.IntVar(&sqliteCacheSize, "sqlite-cache-size", 0, "SQLite cache_size pragma: pages if positive, KiB if negative, 0 for default")
+	flag.Int64Var(&sqliteMmapSize, "sqlite-mmap-size", 0, "SQLite mmap_size pragma in bytes, 0 for default")
+	flag.DurationVar(&connMaxLifetime, "conn-max-lifetime", 0, "maximum time to reuse an SQLite connection, 0 for no limit")
+	flag.BoolVar(&serveGeographic, "epsg4326", false, "serve raster layers reprojected to EPSG:4326 at /4326/{layer}/{z}/{x}/{y}")
+	flag.StringVar(&tlsCert, "tls-cert", "", "TLS certificate file, enables HTTPS together with -tls-key")
+	flag.StringVar(&tlsKey, "tls-key", "", "TLS private key file")
+	flag.BoolVar(&http2Enabled, "http2", http2Enabled, "offer HTTP/2 on TLS connections, false to serve HTTP/1.1 only")
+	flag.IntVar(&httpRedirectPort, "http-redirect-port", 0, "with TLS, plain HTTP port redirecting to HTTPS")
+	flag.Int64Var(&maxTileBytes, "max-tile-bytes", maxTileBytes, "largest tile served in bytes, 0 for no limit")
+	flag.BoolVar(&anyExtension, "any-extension", false, "serve tiles under any URL extension instead of only the one matching the layer format")
+	flag.BoolVar(&selfTest, "selftest", false, "read a sample tile from each layer at startup and log failures")
+	flag.BoolVar(&requireLayers, "require-layers", false, "with -selftest, exit if any layer fails or no layers are found")
+	flag.DurationVar(&slowThreshold, "slow-threshold", 0, "log tile reads taking longer than this, 0 to disable")
+	flag.StringVar(&upstream, "upstream", "", "tile URL template with {z}, {x}, {y} (XYZ), {-y} (TMS) and {layer}, fetched on local misses")
+	flag.DurationVar(&upstreamTimeout, "upstream-timeout", upstreamTimeout, "timeout of upstream tile requests")
+	flag.BoolVar(&upstreamWriteBack, "upstream-write-back", false, "store tiles fetched from upstream in the mbtiles file of the layer")
+	flag.BoolVar(&analyzeFiles, "analyze", false, "run ANALYZE on each mbtiles file the first time it is opened, to improve query plans")
+	flag.BoolVar(&tileURLExtension, "tile-url-extension", false, "advertise tile URLs ending in the layer format extension, e.g. .png")
+	flag.BoolVar(&serveEmptyTiles, "serve-empty-tiles", false, "serve zero-length tiles instead of answering 404")
+	keepAlive := flag.Bool("keepalive", true, "keep HTTP connections open between requests")
+	idleTimeout := flag.Duration("idle-timeout", 0, "close kept-alive connections idle for longer than this, 0 for no limit")
+	flag.BoolVar(&buildIndexes, "build-indexes", false, "write .idx presence indexes of mbtiles files lacking an up-to-date one")
+	apiKeysFile := flag.String("api-keys", "", "JSON file mapping API keys to the layer name globs they may access")
+	notFoundFile := flag.String("notfound-body", "", "file answered with 404 for paths matching no endpoint, as HTML or JSON by its extension")
+	errorStatusFlag := flag.String("error-status", "", "status answered instead of 500 per class of tile read errors, e.g. busy=503,corrupt=404; classes: "+strings.Join(errorClasses, ", "))
+	flag.BoolVar(&errorDetail, "error-detail", false, "include error text in bodies of failed tile responses")
+	flag.IntVar(&busyRetries, "busy-retries", 3, "number of retries of tile queries failing with database busy or locked")
 	flag.Parse()
-	go updateLayers(dataDir)
-	http.HandleFunc("/", route)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf("%s:%d", *host, *port), nil))
+	corsOrigins = parseCORSOrigins(*corsOriginList)
+	if *logJSON {
+		setupJSONLogging()
+	}
+	if *apiKeysFile != "" {
+		var err error
+		if apiKeys, err = loadAPIKeys(*apiKeysFile); err != nil {
+			log.Fatalf("Error loading API keys from \"%s\": %s", *apiKeysFile, err)
+		}
+	}
+	// With API keys, tiles are not served to anyone who can reach the host.
+	if isWildcardHost(*host) && len(apiKeys) == 0 {
+		if *requirePublicFlag && !*allowPublic {
+			log.Fatalf("Refusing to listen on all interfaces (\"%s\") without -allow-public", *host)
+		}
+		log.Printf("WARNING: listening on all interfaces (\"%s\"), tiles are served to anyone who can reach this host", *host)
+	}
+	if *watermarkFile != "" {
+		var err error
+		watermark, err = loadWatermark(*watermarkFile, *watermarkPos)
+		if err != nil {
+			log.Fatalf("Error loading watermark \"%s\": %s", *watermarkFile, err)
+		}
+	}
+	if watermark != nil || hasTileProcessor() {
+		tileCache = newTileCache(*cacheSize)
+	}
+	if serveGeographic {
+		geographicCache = newTileCache(*cacheSize)
+	}
+	if maxTileScale < 1 {
+		log.Fatalf("-max-scale must be at least 1")
+	}
+	if maxTileScale > 1 {
+		scaledCache = newTileCache(*cacheSize)
+	}
+	if gzipLevel != gzip.DefaultCompression && (gzipLevel < gzip.BestSpeed || gzipLevel > gzip.BestCompression) {
+		log.Fatalf("-gzip-level must be between 1 and 9, or -1")
+	}
+	if compressMinBytes < 0 {
+		log.Fatalf("-compress-min-bytes must not be negative")
+	}
+	if connMaxLifetime < 0 {
+		log.Fatalf("-conn-max-lifetime must not be negative")
+	}
+	if sqliteMmapSize < 0 {
+		log.Fatalf("-sqlite-mmap-size must not be negative")
+	}
+	if sqliteCacheSize != 0 || sqliteMmapSize != 0 {
+		log.Printf("SQLite cache_size=%d mmap_size=%d", sqliteCacheSize, sqliteMmapSize)
+	}
+	if (tlsCert == "") != (tlsKey == "") {
+		log.Fatalf("-tls-cert and -tls-key must be used together")
+	}
+	if httpRedirectPort != 0 && tlsCert == "" {
+		log.Fatalf("-http-redirect-port requires -tls-cert and -tls-key")
+	}
+	switch onConflict {
+	case "first", "last", "error", "suffix":
+	default:
+		log.Fatalf("-on-conflict must be one of first, last, error or suffix")
+	}
+	switch slashMode {
+	case "strict", "serve", "redirect":
+	default:
+		log.Fatalf("-slashes must be one of strict, serve or redirect")
+	}
+	if coordOrder != "zxy" && coordOrder != "zyx" {
+		log.Fatalf("-coord-order must be zxy or zyx")
+	}
+	if upstreamWriteBack && upstream == "" {
+		log.Fatalf("-upstream-write-back requires -upstream")
+	}
+	if upstreamWriteBack && localSnapshot {
+		log.Fatalf("-upstream-write-back can not be used with -local-snapshot")
+	}
+	if upstreamWriteBack && buildIndexes {
+		log.Fatalf("-upstream-write-back can not be used with -build-indexes")
+	}
+	if *idleTimeout < 0 {
+		log.Fatalf("-idle-timeout must not be negative")
+	}
+	if *notFoundFile != "" {
+		if err := loadNotFoundBody(*notFoundFile); err != nil {
+			log.Fatalf("Invalid -notfound-body: %s", err)
+		}
+	}
+	if status, err := parseErrorStatus(*errorStatusFlag); err != nil {
+		log.Fatalf("Invalid -error-status: %s", err)
+	} else {
+		errorStatus = status
+	}
+	if layerConcurrency < 0 {
+		log.Fatalf("-layer-concurrency must not be negative")
+	}
+	if scanWorkers < 1 {
+		log.Fatalf("-scan-workers must be at least 1")
+	}
+	if fi, err := os.Stat(dataDir); err == nil && !fi.IsDir() {
+		if singleName == "" {
+			singleName = layerBaseName(dataDir)
+		}
+	} else if singleName != "" {
+		log.Fatalf("-name requires -path to be a single mbtiles file")
+	}
+	if singleName != "" && len(tenants) > 0 {
+		log.Fatalf("-tenant requires -path to be a directory")
+	}
+	if selfTest {
+		scanLayers()
+		if !runSelfTest() && requireLayers {
+			log.Fatalf("Self-test failed")
+		}
+	}
+	go updateLayers()
+	go handleReloadSignal()
+	go handleMaintenanceSignal()
+	var handler http.Handler = http.HandlerFunc(route)
+	handler = withCanonicalPaths(handler)
+	handler = withGzip(handler)
+	handler = withServerHeader(handler, *serverHeader)
+	server := &http.Server{
+		Addr:        fmt.Sprintf("%s:%d", *host, *port),
+		Handler:     handler,
+		IdleTimeout: *idleTimeout,
+	}
+	// Go listens with the system's maximum backlog, which can not be set
+	// per listener; tune net.core.somaxconn instead.
+	server.SetKeepAlivesEnabled(*keepAlive)
+	log.Fatal(serve(server, *host, *port))
 
 }
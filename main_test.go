@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testPNG is the signature of a PNG file, enough for tiles to be sniffed as
+// PNG.
+var testPNG = []byte("\x89PNG\r\n\x1a\n")
+
+// writeTestMBTiles creates an mbtiles file with metadata and tiles keyed by
+// z, x and TMS y.
+func writeTestMBTiles(t *testing.T, path string, metadata map[string]string, tiles map[[3]int][]byte) {
+	t.Helper()
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, stmt := range []string{
+		"CREATE TABLE metadata (name TEXT, value TEXT)",
+		"CREATE TABLE tiles (zoom_level INTEGER, tile_column INTEGER, tile_row INTEGER, tile_data BLOB)",
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, value := range metadata {
+		if _, err := db.Exec("INSERT INTO metadata VALUES (?, ?)", name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for c, data := range tiles {
+		if _, err := db.Exec("INSERT INTO tiles VALUES (?, ?, ?, ?)", c[0], c[1], c[2], data); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// useDataDir serves the layers of dir for the rest of the test.
+func useDataDir(t *testing.T, dir string) {
+	savedDir, savedLayers := dataDir, layers
+	dataDir, layers = dir, make(map[string]*Layer)
+	t.Cleanup(func() {
+		scanMu.Lock()
+		for _, layer := range layers {
+			if layer.valid {
+				layer.activeRequests.Done()
+			}
+		}
+		dataDir, layers = savedDir, savedLayers
+		scanMu.Unlock()
+	})
+}
+
+// serveTest routes a request with the given header values, as "Name: value".
+func serveTest(method, target string, header ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	for _, h := range header {
+		name, value, _ := strings.Cut(h, ": ")
+		req.Header.Add(name, value)
+	}
+	resp := httptest.NewRecorder()
+	route(resp, req)
+	return resp
+}
+
+// TestDeleteLayerFileUnderLoad deletes the file of a layer while clients
+// request its tiles, checking that requests get the tile or a 404, that the
+// layer is disposed and that the deleted file is not recreated.
+func TestDeleteLayerFileUnderLoad(t *testing.T) {
+	for _, lifetime := range []time.Duration{0, time.Millisecond} {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "a.mbtiles")
+		writeTestMBTiles(t, path, map[string]string{"format": "png"}, map[[3]int][]byte{{0, 0, 0}: testPNG})
+		useDataDir(t, dir)
+		savedLifetime := connMaxLifetime
+		connMaxLifetime = lifetime
+		scanLayers()
+		connMaxLifetime = savedLifetime
+		startingRequests.RLock()
+		layer := layers["a"]
+		startingRequests.RUnlock()
+		if layer == nil || !layer.valid {
+			t.Fatal("layer not loaded")
+		}
+
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		statuses := make(map[int]int)
+		for i := 0; i < 16; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					resp := httptest.NewRecorder()
+					route(resp, httptest.NewRequest(http.MethodGet, "/a/0/0/0.png", nil))
+					mu.Lock()
+					statuses[resp.Code]++
+					mu.Unlock()
+				}
+			}()
+		}
+		time.Sleep(50 * time.Millisecond)
+		if err := os.Remove(path); err != nil {
+			t.Fatal(err)
+		}
+		scanLayers()
+		time.Sleep(50 * time.Millisecond)
+		close(stop)
+		wg.Wait()
+
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("lifetime %s: deleted file recreated", lifetime)
+		}
+		for status, n := range statuses {
+			if status != http.StatusOK && status != http.StatusNotFound {
+				t.Errorf("lifetime %s: %d responses with status %d", lifetime, n, status)
+			}
+		}
+		if statuses[http.StatusNotFound] == 0 {
+			t.Errorf("lifetime %s: no request saw the layer removed: %v", lifetime, statuses)
+		}
+		deadline := time.Now().Add(2 * time.Second)
+		for layer.conn.Stats().OpenConnections > 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("lifetime %s: layer not disposed after its requests finished", lifetime)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestParseTileCoords(t *testing.T) {
+	tests := []struct {
+		z, x, y string
+		want    [3]int
+		wantErr bool
+	}{
+		{"3", "2", "1", [3]int{3, 2, 1}, false},
+		{"0", "0", "0", [3]int{0, 0, 0}, false},
+		{"1e3", "0", "0", [3]int{}, true},
+		{"3", "2.0", "1", [3]int{}, true},
+		{"3", "2", "0x1", [3]int{}, true},
+		{"3", "", "1", [3]int{}, true},
+		{"3", "two", "1", [3]int{}, true},
+		{"99999999999999999999", "0", "0", [3]int{}, true},
+		{"3", "0", "-99999999999999999999", [3]int{}, true},
+	}
+	for _, tt := range tests {
+		z, x, y, err := parseTileCoords(tt.z, tt.x, tt.y)
+		if (err != nil) != tt.wantErr || [3]int{z, x, y} != tt.want {
+			t.Errorf("parseTileCoords(%q, %q, %q) = %d, %d, %d, %v", tt.z, tt.x, tt.y, z, x, y, err)
+		}
+	}
+}
+
+// TestCoordOrder parses and serves tile URLs in both coordinate orders and
+// checks the order of the advertised URL template.
+func TestCoordOrder(t *testing.T) {
+	dir := t.TempDir()
+	writeTestMBTiles(t, filepath.Join(dir, "r.mbtiles"), map[string]string{"format": "png"},
+		map[[3]int][]byte{{2, 3, 1}: testPNG})
+	useDataDir(t, dir)
+	scanLayers()
+	saved := coordOrder
+	defer func() { coordOrder = saved }()
+
+	tests := []struct {
+		order                     string
+		parsed                    [3]int
+		found, notFound, template string
+	}{
+		{"zxy", [3]int{2, 1, 3}, "/r/2/3/1.png", "/r/2/1/3.png", "/r/{z}/{x}/{y}"},
+		{"zyx", [3]int{2, 3, 1}, "/r/2/1/3.png", "/r/2/3/1.png", "/r/{z}/{y}/{x}"},
+	}
+	for _, tt := range tests {
+		coordOrder = tt.order
+		if z, x, y, err := parseTileCoords("2", "1", "3"); err != nil || [3]int{z, x, y} != tt.parsed {
+			t.Errorf("%s: parseTileCoords(\"2\", \"1\", \"3\") = %d, %d, %d, %v", tt.order, z, x, y, err)
+		}
+		if resp := serveTest(http.MethodGet, tt.found); resp.Code != http.StatusOK {
+			t.Errorf("%s: %s: status %d, want 200", tt.order, tt.found, resp.Code)
+		}
+		if resp := serveTest(http.MethodGet, tt.notFound); resp.Code != http.StatusNotFound {
+			t.Errorf("%s: %s: status %d, want 404", tt.order, tt.notFound, resp.Code)
+		}
+		if body := serveTest(http.MethodGet, "/r.json").Body.String(); !strings.Contains(body, tt.template) {
+			t.Errorf("%s: TileJSON does not advertise %s: %s", tt.order, tt.template, body)
+		}
+	}
+}
+
+func TestMalformedCoordinatesStatus(t *testing.T) {
+	dir := t.TempDir()
+	writeTestMBTiles(t, filepath.Join(dir, "r.mbtiles"), map[string]string{"format": "png"},
+		map[[3]int][]byte{{0, 0, 0}: testPNG})
+	useDataDir(t, dir)
+	scanLayers()
+	for path, want := range map[string]int{
+		"/r/0/0/0.png":                    http.StatusOK,
+		"/r/1/0/0.png":                    http.StatusNotFound,
+		"/r/1e3/0/0.png":                  http.StatusBadRequest,
+		"/r/0/x/0.png":                    http.StatusBadRequest,
+		"/r/0/0/99999999999999999999.png": http.StatusBadRequest,
+	} {
+		if resp := serveTest(http.MethodGet, path); resp.Code != want {
+			t.Errorf("%s: status %d, want %d", path, resp.Code, want)
+		}
+	}
+}
+
+func TestSanitizeLayerName(t *testing.T) {
+	tests := map[string]string{
+		"osm":                   "osm",
+		"osm-2024_v1.2":         "osm-2024_v1.2",
+		"карта":                 "карта",
+		`a"<script>b`:           "a__script_b",
+		"x</script><b>":         "x__script__b_",
+		"it's & \"quoted\"":     "it_s____quoted_",
+		"../../etc":             ".._.._etc",
+		"a/b\\c":                "a_b_c",
+		"tab\tnew\nline":        "tab_new_line",
+		"":                      "_",
+		"..":                    "_..",
+		"javascript:alert(1)//": "javascript_alert_1___",
+	}
+	for name, want := range tests {
+		if got := sanitizeLayerName(name); got != want {
+			t.Errorf("sanitizeLayerName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestMaliciousLayerFileName(t *testing.T) {
+	dir := t.TempDir()
+	// File names can not contain a slash, so there is no </script>.
+	name := `x"><script>alert('1')<script>`
+	writeTestMBTiles(t, filepath.Join(dir, name+".mbtiles"), map[string]string{"format": "png"},
+		map[[3]int][]byte{{0, 0, 0}: testPNG})
+	useDataDir(t, dir)
+	scanLayers()
+
+	safe := sanitizeLayerName(name)
+	startingRequests.RLock()
+	_, ok := layers[safe]
+	n := len(layers)
+	startingRequests.RUnlock()
+	if !ok || n != 1 {
+		t.Fatalf("layer not registered as %q only", safe)
+	}
+	if resp := serveTest(http.MethodGet, "/"+safe+"/0/0/0.png"); resp.Code != http.StatusOK {
+		t.Errorf("tile of sanitized layer: status %d", resp.Code)
+	}
+	for _, path := range []string{"/", "/list", "/layers.json"} {
+		body := serveTest(http.MethodGet, path).Body.String()
+		if strings.Contains(body, "<script>alert") || strings.Contains(body, `x">`) {
+			t.Errorf("%s contains the raw file name: %s", path, body)
+		}
+		if !strings.Contains(body, safe) {
+			t.Errorf("%s does not list %q", path, safe)
+		}
+	}
+}
+
+// TestQueryTile reads tiles from an in-memory database, checking that
+// zero-length tiles are left out unless -serve-empty-tiles is set and that
+// tiles over -max-tile-bytes are refused.
+func TestQueryTile(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	for _, stmt := range []string{
+		"CREATE TABLE tiles (zoom_level INTEGER, tile_column INTEGER, tile_row INTEGER, tile_data BLOB)",
+		"INSERT INTO tiles VALUES (0, 0, 0, x'0102030405')",
+		"INSERT INTO tiles VALUES (1, 0, 0, x'')",
+		"INSERT INTO tiles VALUES (1, 1, 0, NULL)",
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	savedEmpty, savedMax := serveEmptyTiles, maxTileBytes
+	defer func() { serveEmptyTiles, maxTileBytes = savedEmpty, savedMax }()
+	var columns TileColumns
+	columns.setDefaults(tilesTable)
+
+	for _, tc := range []struct {
+		name    string
+		x, y, z int
+		empty   bool
+		max     int64
+		want    []byte
+		wantErr error
+	}{
+		{name: "tile", want: []byte{1, 2, 3, 4, 5}},
+		{name: "missing", x: 1, y: 1, z: 1},
+		{name: "empty", z: 1},
+		{name: "null", x: 1, z: 1},
+		{name: "empty served", z: 1, empty: true, want: []byte{}},
+		{name: "at limit", max: 5, want: []byte{1, 2, 3, 4, 5}},
+		{name: "over limit", max: 4, wantErr: errTileTooLarge},
+		{name: "empty under limit", z: 1, max: 4},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			serveEmptyTiles, maxTileBytes = tc.empty, tc.max
+			stmt, err := db.Prepare(tileQuery(columns))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer stmt.Close()
+			got, err := queryTile(context.Background(), stmt, tc.x, tc.y, tc.z)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("error %v, want %v", err, tc.wantErr)
+			}
+			if !bytes.Equal(got, tc.want) || (got == nil) != (tc.want == nil) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// TestEmptyTileStatus requests a zero-length tile over HTTP.
+func TestEmptyTileStatus(t *testing.T) {
+	dir := t.TempDir()
+	writeTestMBTiles(t, filepath.Join(dir, "empty.mbtiles"), map[string]string{"format": "png"},
+		map[[3]int][]byte{{0, 0, 0}: {}})
+	useDataDir(t, dir)
+	scanLayers()
+	savedEmpty := serveEmptyTiles
+	defer func() { serveEmptyTiles = savedEmpty }()
+
+	for _, tc := range []struct {
+		empty bool
+		want  int
+	}{{false, http.StatusNotFound}, {true, http.StatusOK}} {
+		serveEmptyTiles = tc.empty
+		resp := serveTest(http.MethodGet, "/empty/0/0/0.png")
+		if resp.Code != tc.want {
+			t.Errorf("serveEmptyTiles %v: status %d, want %d", tc.empty, resp.Code, tc.want)
+		}
+		if resp.Code == http.StatusOK && resp.Body.Len() != 0 {
+			t.Errorf("serveEmptyTiles %v: body of %d bytes", tc.empty, resp.Body.Len())
+		}
+	}
+}
+
+// TestUnreadableDataDir makes the data directory unreadable between scans,
+// checking that the layers are kept and the error is reported until the
+// directory can be read again.
+func TestUnreadableDataDir(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		damage, repair func(dir string) error
+	}{
+		{
+			name:   "no permission",
+			damage: func(dir string) error { return os.Chmod(dir, 0) },
+			repair: func(dir string) error { return os.Chmod(dir, 0o755) },
+		},
+		{
+			name: "not a directory",
+			damage: func(dir string) error {
+				if err := os.Rename(dir, dir+".moved"); err != nil {
+					return err
+				}
+				return os.WriteFile(dir, nil, 0o644)
+			},
+			repair: func(dir string) error {
+				if err := os.Remove(dir); err != nil {
+					return err
+				}
+				return os.Rename(dir+".moved", dir)
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "data")
+			if err := os.Mkdir(dir, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			writeTestMBTiles(t, filepath.Join(dir, "a.mbtiles"), map[string]string{"format": "png"},
+				map[[3]int][]byte{{0, 0, 0}: testPNG})
+			useDataDir(t, dir)
+			savedScanError := lastScanError
+			defer func() { lastScanError = savedScanError }()
+			if result := scanLayers(); len(result.Added) != 1 || result.Error != "" {
+				t.Fatalf("first scan: %+v", result)
+			}
+
+			if err := tc.damage(dir); err != nil {
+				t.Fatal(err)
+			}
+			defer tc.repair(dir)
+			if _, err := os.ReadDir(dir); err == nil {
+				t.Skip("directory is still readable, probably running as root")
+			}
+			result := scanLayers()
+			if result.Error == "" || len(result.Removed) != 0 {
+				t.Errorf("scan of broken directory: %+v", result)
+			}
+			if resp := serveTest(http.MethodGet, "/a/0/0/0.png"); resp.Code != http.StatusOK {
+				t.Errorf("tile of kept layer: status %d", resp.Code)
+			}
+
+			if err := tc.repair(dir); err != nil {
+				t.Fatal(err)
+			}
+			if result := scanLayers(); result.Error != "" || len(result.Removed) != 0 {
+				t.Errorf("scan of repaired directory: %+v", result)
+			}
+			if lastScanError != "" {
+				t.Errorf("scan error still reported: %s", lastScanError)
+			}
+		})
+	}
+}
+
+func TestTileSource(t *testing.T) {
+	if got := (&Layer{}).tileSource(); got != "sqlite" {
+		t.Errorf("mbtiles layer: %q", got)
+	}
+	if got := (&Layer{pmtiles: &PMTiles{}}).tileSource(); got != "pmtiles" {
+		t.Errorf("pmtiles layer: %q", got)
+	}
+}
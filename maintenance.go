@@ -0,0 +1,91 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var maintenance atomic.Bool
+var maintenanceTimeout time.Duration
+var maintenanceRetryAfter time.Duration
+
+var maintenanceMu sync.Mutex
+var maintenanceTimer *time.Timer
+
+// setMaintenance switches maintenance mode. While it is on, tile requests are
+// answered with 503. It switches off by itself after maintenanceTimeout.
+func setMaintenance(on bool) {
+	maintenanceMu.Lock()
+	defer maintenanceMu.Unlock()
+	if maintenanceTimer != nil {
+		maintenanceTimer.Stop()
+		maintenanceTimer = nil
+	}
+	if maintenance.Swap(on) != on {
+		if on {
+			log.Printf("Maintenance mode enabled")
+		} else {
+			log.Printf("Maintenance mode disabled")
+		}
+	}
+	if on && maintenanceTimeout > 0 {
+		maintenanceTimer = time.AfterFunc(maintenanceTimeout, func() {
+			log.Printf("Maintenance mode timed out")
+			setMaintenance(false)
+		})
+	}
+}
+
+func handleMaintenanceSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	for range signals {
+		setMaintenance(!maintenance.Load())
+	}
+}
+
+// inMaintenance answers the request with 503 if maintenance mode is on.
+func inMaintenance(resp http.ResponseWriter) bool {
+	if !maintenance.Load() {
+		return false
+	}
+	resp.Header().Set("Retry-After", strconv.Itoa(int(maintenanceRetryAfter.Seconds())))
+	http.Error(resp, "under maintenance", http.StatusServiceUnavailable)
+	return true
+}
+
+// maintenanceResponse handles POST /admin/maintenance?enabled=true|false.
+// Without the parameter maintenance mode is enabled.
+func maintenanceResponse(resp http.ResponseWriter, req *http.Request) {
+	on := true
+	if v := req.URL.Query().Get("enabled"); v != "" {
+		var err error
+		if on, err = strconv.ParseBool(v); err != nil {
+			http.Error(resp, "invalid enabled value", http.StatusBadRequest)
+			return
+		}
+	}
+	setMaintenance(on)
+	writeJSON(resp, req, map[string]bool{"maintenance": on})
+}
+
+// healthResponse answers liveness checks, and with ?deep=1 readiness checks
+// that query SQLite.
+func healthResponse(resp http.ResponseWriter, req *http.Request) {
+	resp.Header().Set("Content-Type", "text/plain")
+	if req.URL.Query().Get("deep") == "1" {
+		if err := checkDeepHealth(); err != nil {
+			resp.WriteHeader(http.StatusServiceUnavailable)
+			resp.Write([]byte("error: " + err.Error() + "\n"))
+			return
+		}
+	}
+	resp.Write([]byte("ok\n"))
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+// TileMeta describes a stored tile for /{layer}/{z}/{x}/{y}/meta.
+type TileMeta struct {
+	Found       bool   `json:"found"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type,omitempty"`
+	Encoding    string `json:"encoding,omitempty"`
+	Cached      bool   `json:"cached"`
+}
+
+// tileSize returns the stored size of a tile, or -1 if it does not exist.
+func (layer *Layer) tileSize(x, y, z int) (int64, error) {
+	if layer.pmtiles != nil {
+		_, length, found, err := layer.pmtiles.find(x, y, z)
+		if err != nil || !found {
+			return -1, err
+		}
+		return int64(length), nil
+	}
+	if layer.customReader() {
+		data, err := layer.tile(context.Background(), x, y, z)
+		if err != nil || data == nil {
+			return -1, err
+		}
+		return int64(len(data)), nil
+	}
+	c := layer.config.Columns
+	rows, err := layer.conn.Query("SELECT length("+quoteIdent(c.Data)+") FROM "+c.from()+" WHERE "+c.where(), z, x, y)
+	if err != nil {
+		return -1, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return -1, rows.Err()
+	}
+	var size int64
+	if err := rows.Scan(&size); err != nil {
+		return -1, err
+	}
+	if size == 0 && !serveEmptyTiles {
+		return -1, nil
+	}
+	return size, nil
+}
+
+// tileMetaResponse reports size and format of a tile without sending it. It
+// is only routed with -debug-headers, as it exposes server internals.
+func tileMetaResponse(resp http.ResponseWriter, req *http.Request) {
+	urlFields := layerPathFields(req.URL.Path)
+	if len(urlFields) != 6 {
+		http.NotFound(resp, req)
+		return
+	}
+	name := urlFields[1]
+	layer := acquireRequestLayer(resp, req, name)
+	if layer == nil {
+		return
+	}
+	defer layer.activeRequests.Done()
+	if !layer.valid {
+		http.Error(resp, "layer invalid", 500)
+		return
+	}
+	z, x, y, err := parseTileCoords(urlFields[2], urlFields[3], urlFields[4])
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+	stored, storedZ, ok := layer.storedTile(x, y, z)
+	if !ok {
+		writeJSON(resp, req, TileMeta{})
+		return
+	}
+	size, err := layer.tileSize(x, stored, storedZ)
+	if err != nil {
+		logTileError("Error checking tile", name, z, x, y, err)
+		http.Error(resp, "", 500)
+		return
+	}
+	meta := TileMeta{Found: size >= 0, Size: size}
+	if !meta.Found {
+		meta.Size = 0
+		writeJSON(resp, req, meta)
+		return
+	}
+	_, _, meta.Cached = tileCache.get(tileKey{layer, "", 1, x, stored, storedZ})
+	if layer.formatType != "" && !alwaysSniff {
+		meta.ContentType, meta.Encoding = layer.formatType, layer.formatEncoding
+	} else {
+		data, err := layer.tile(req.Context(), x, stored, storedZ)
+		if err != nil {
+			logTileError("Error getting tile", name, z, x, y, err)
+			http.Error(resp, "", 500)
+			return
+		}
+		meta.ContentType, meta.Encoding = layer.contentType(data)
+	}
+	writeJSON(resp, req, meta)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var serveMetrics bool
+
+// Scan statistics, updated by updateLayers after every periodic scan.
+var (
+	lastScanSuccess  atomic.Int64 // Unix time
+	lastScanDuration atomic.Int64 // nanoseconds
+	scanErrors       atomic.Int64
+)
+
+func recordScan(duration time.Duration, result ScanResult) {
+	lastScanDuration.Store(int64(duration))
+	if result.Error != "" {
+		scanErrors.Add(1)
+	} else {
+		lastScanSuccess.Store(time.Now().Unix())
+	}
+}
+
+// metricsResponse writes metrics in the Prometheus text exposition format.
+func metricsResponse(resp http.ResponseWriter, req *http.Request) {
+	resp.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	// Both counts are taken in one pass, so that they agree during scans.
+	startingRequests.RLock()
+	defer startingRequests.RUnlock()
+	var names []string
+	invalid := 0
+	for name, layer := range layers {
+		if layer.valid {
+			names = append(names, name)
+		} else {
+			invalid++
+		}
+	}
+	sort.Strings(names)
+	fmt.Fprintln(resp, "# HELP mbtiles_layers Number of layers being served.")
+	fmt.Fprintln(resp, "# TYPE mbtiles_layers gauge")
+	fmt.Fprintf(resp, "mbtiles_layers %d\n", len(names))
+	fmt.Fprintln(resp, "# HELP mbtiles_invalid_layers Number of layers whose file failed to open.")
+	fmt.Fprintln(resp, "# TYPE mbtiles_invalid_layers gauge")
+	fmt.Fprintf(resp, "mbtiles_invalid_layers %d\n", invalid)
+	fmt.Fprintln(resp, "# HELP mbtiles_last_scan_success_timestamp_seconds Time of the last scan that read the data directory.")
+	fmt.Fprintln(resp, "# TYPE mbtiles_last_scan_success_timestamp_seconds gauge")
+	fmt.Fprintf(resp, "mbtiles_last_scan_success_timestamp_seconds %d\n", lastScanSuccess.Load())
+	fmt.Fprintln(resp, "# HELP mbtiles_last_scan_duration_seconds Duration of the last scan.")
+	fmt.Fprintln(resp, "# TYPE mbtiles_last_scan_duration_seconds gauge")
+	fmt.Fprintf(resp, "mbtiles_last_scan_duration_seconds %g\n", time.Duration(lastScanDuration.Load()).Seconds())
+	fmt.Fprintln(resp, "# HELP mbtiles_scan_errors_total Number of scans that failed to read the data directory.")
+	fmt.Fprintln(resp, "# TYPE mbtiles_scan_errors_total counter")
+	fmt.Fprintf(resp, "mbtiles_scan_errors_total %d\n", scanErrors.Load())
+	fmt.Fprintln(resp, "# HELP mbtiles_client_aborts_total Tile responses cut short by the client disconnecting.")
+	fmt.Fprintln(resp, "# TYPE mbtiles_client_aborts_total counter")
+	fmt.Fprintf(resp, "mbtiles_client_aborts_total %d\n", clientAborts.Load())
+	fmt.Fprintln(resp, "# HELP mbtiles_write_errors_total Tile responses that failed to be sent for other reasons.")
+	fmt.Fprintln(resp, "# TYPE mbtiles_write_errors_total counter")
+	fmt.Fprintf(resp, "mbtiles_write_errors_total %d\n", writeErrors.Load())
+	fmt.Fprintln(resp, "# HELP mbtiles_layer_error Whether the last tile read of the layer failed.")
+	fmt.Fprintln(resp, "# TYPE mbtiles_layer_error gauge")
+	for _, name := range names {
+		err, _ := layers[name].lastError()
+		fmt.Fprintf(resp, "mbtiles_layer_error{layer=%s} %d\n", promLabel(name), boolToInt(err != nil))
+	}
+	fmt.Fprintln(resp, "# HELP mbtiles_layer_last_error_timestamp_seconds Time of the last failed tile read of the layer.")
+	fmt.Fprintln(resp, "# TYPE mbtiles_layer_last_error_timestamp_seconds gauge")
+	for _, name := range names {
+		if err, t := layers[name].lastError(); err != nil {
+			fmt.Fprintf(resp, "mbtiles_layer_last_error_timestamp_seconds{layer=%s} %d\n", promLabel(name), t.Unix())
+		}
+	}
+}
+
+// promLabel quotes a label value as required by the exposition format.
+func promLabel(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value) + `"`
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
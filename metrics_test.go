@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLayerCountMetrics(t *testing.T) {
+	dir := t.TempDir()
+	writeTestMBTiles(t, filepath.Join(dir, "good.mbtiles"), map[string]string{"format": "png"},
+		map[[3]int][]byte{{0, 0, 0}: testPNG})
+	if err := os.WriteFile(filepath.Join(dir, "bad.mbtiles"), []byte("not a database"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	useDataDir(t, dir)
+	scanLayers()
+	saved := serveMetrics
+	defer func() { serveMetrics = saved }()
+	serveMetrics = true
+
+	body := serveTest(http.MethodGet, "/metrics").Body.String()
+	for _, want := range []string{"mbtiles_layers 1\n", "mbtiles_invalid_layers 1\n", `mbtiles_layer_error{layer="good"} 0`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics do not contain %q:\n%s", want, body)
+		}
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+func withServerHeader(next http.Handler, value string) http.Handler {
+	if value == "" {
+		return next
+	}
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Server", value)
+		next.ServeHTTP(resp, req)
+	})
+}
+
+// corsOrigins lists the origins allowed to read responses cross-origin. An
+// entry is either an origin such as "https://maps.example.com" or a pattern
+// like "*.example.com" or "https://*.example.com" matching its subdomains.
+// When empty, any origin is allowed.
+var corsOrigins []string
+
+func parseCORSOrigins(value string) []string {
+	var origins []string
+	for _, origin := range strings.Split(value, ",") {
+		if origin = strings.ToLower(strings.TrimSpace(origin)); origin != "" {
+			origins = append(origins, strings.TrimSuffix(origin, "/"))
+		}
+	}
+	return origins
+}
+
+func originAllowed(origin string) bool {
+	origin = strings.ToLower(origin)
+	scheme, host, ok := strings.Cut(origin, "://")
+	if !ok {
+		return false
+	}
+	for _, pattern := range corsOrigins {
+		patternScheme, patternHost, hasScheme := strings.Cut(pattern, "://")
+		if !hasScheme {
+			patternScheme, patternHost = "", pattern
+		}
+		if patternScheme != "" && patternScheme != scheme {
+			continue
+		}
+		if suffix, wildcard := strings.CutPrefix(patternHost, "*."); wildcard {
+			if strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+		} else if patternHost == host {
+			return true
+		}
+	}
+	return false
+}
+
+// allowOrigin sets Access-Control-Allow-Origin: "*" without -cors-origins,
+// otherwise the request origin if it is allowed.
+func allowOrigin(resp http.ResponseWriter, req *http.Request) {
+	if len(corsOrigins) == 0 {
+		resp.Header().Set("Access-Control-Allow-Origin", "*")
+		return
+	}
+	resp.Header().Add("Vary", "Origin")
+	if origin := req.Header.Get("Origin"); origin != "" && originAllowed(origin) {
+		resp.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+}
+
+// slashMode selects how paths with a trailing slash or empty segments, such
+// as /osm/5/10/12/ or /osm//5/10/12, are handled: "strict" routes them as they
+// are, "serve" routes them as the canonical path and "redirect" redirects
+// to it. The /{layer}/ pages of -layer-index of existing layers keep their
+// trailing slash.
+var slashMode = "strict"
+
+func canonicalPath(path string) string {
+	var segments []string
+	for _, segment := range strings.Split(path, "/") {
+		if segment != "" {
+			segments = append(segments, segment)
+		}
+	}
+	canonical := "/" + strings.Join(segments, "/")
+	if serveLayerIndex && canonical != "/" && strings.HasSuffix(path, "/") {
+		if name, _, _, ok := layerIndexPath(canonical + "/"); ok {
+			startingRequests.RLock()
+			_, open := layers[name]
+			_, closed := closedLayers[name]
+			startingRequests.RUnlock()
+			if open || closed {
+				canonical += "/"
+			}
+		}
+	}
+	return canonical
+}
+
+func withCanonicalPaths(next http.Handler) http.Handler {
+	if slashMode == "strict" {
+		return next
+	}
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		canonical := canonicalPath(req.URL.Path)
+		if canonical == req.URL.Path || !isServerMethod(req.Method) {
+			next.ServeHTTP(resp, req)
+			return
+		}
+		u := *req.URL
+		u.Path, u.RawPath = canonical, ""
+		if slashMode == "redirect" {
+			code := http.StatusMovedPermanently
+			if req.Method != http.MethodGet && req.Method != http.MethodHead {
+				code = http.StatusPermanentRedirect
+			}
+			http.Redirect(resp, req, u.RequestURI(), code)
+			return
+		}
+		req.URL = &u
+		next.ServeHTTP(resp, req)
+	})
+}
+
+var readMethods = []string{http.MethodGet, http.MethodHead, http.MethodOptions}
+var postMethods = []string{http.MethodPost, http.MethodOptions}
+
+// maxRequestBody limits the size of request bodies of POST endpoints.
+var maxRequestBody int64 = 1 << 20
+
+// limitBody caps the request body at maxRequestBody. Reading past the limit
+// fails with an *http.MaxBytesError, which handlers answer with 413.
+func limitBody(resp http.ResponseWriter, req *http.Request) {
+	if maxRequestBody > 0 {
+		req.Body = http.MaxBytesReader(resp, req.Body, maxRequestBody)
+	}
+}
+
+// serverMethods are the methods of all routes together. route rejects
+// requests with other methods, such as CONNECT and TRACE sent by scanners,
+// before looking at the path.
+var serverMethods = []string{http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPost}
+
+func isServerMethod(method string) bool {
+	for _, m := range serverMethods {
+		if method == m {
+			return true
+		}
+	}
+	return false
+}
+
+// routeMethods returns the methods allowed by the route of path, as checked
+// by checkMethod in route and adminRoute.
+func routeMethods(path string) []string {
+	if adminToken != "" && strings.HasPrefix(path, "/admin/") {
+		if path == "/admin/layers" {
+			return readMethods
+		}
+		return postMethods
+	}
+	if strings.HasSuffix(path, "/exists") {
+		return postMethods
+	}
+	return readMethods
+}
+
+// checkServerMethod rejects methods of no route, with the methods of the
+// route of the request as Allow. Other methods, and OPTIONS requests, are
+// left to the routes.
+func checkServerMethod(resp http.ResponseWriter, req *http.Request) bool {
+	if isServerMethod(req.Method) {
+		return true
+	}
+	resp.Header().Set("Allow", strings.Join(routeMethods(req.URL.Path), ", "))
+	http.Error(resp, "method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
+
+// checkMethod reports whether the request should be handled further. It
+// answers OPTIONS requests itself and rejects methods not in allowed with 405.
+func checkMethod(resp http.ResponseWriter, req *http.Request, allowed []string) bool {
+	allow := strings.Join(allowed, ", ")
+	if req.Method == http.MethodOptions {
+		resp.Header().Set("Allow", allow)
+		allowOrigin(resp, req)
+		resp.Header().Set("Access-Control-Allow-Methods", allow)
+		resp.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-API-Key")
+		resp.WriteHeader(http.StatusNoContent)
+		return false
+	}
+	for _, method := range allowed {
+		if req.Method == method {
+			return true
+		}
+	}
+	resp.Header().Set("Allow", allow)
+	http.Error(resp, "method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
+
+var gzipLevel = gzip.DefaultCompression
+
+var compressibleTypes = []string{"text/", "application/json", "application/javascript", "application/geo+json", "application/xml"}
+
+func compressible(contentType string) bool {
+	for _, prefix := range compressibleTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// compressMinBytes is the smallest response body that is compressed. Bodies
+// of unknown length are buffered up to it before deciding.
+var compressMinBytes = 1024
+
+// gzipResponseWriter compresses successful responses with a compressible
+// content type for clients accepting gzip, unless they are shorter than
+// compressMinBytes. The decision is taken when the header is written, or with
+// an unknown Content-Length once enough of the body is, so handlers must set
+// Content-Type before writing the header.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	req     *http.Request
+	gz      *gzip.Writer
+	decided bool
+	// pending is the status held back while buf collects the start of a body
+	// of unknown length.
+	pending int
+	buf     []byte
+}
+
+func (w *gzipResponseWriter) WriteHeader(code int) {
+	if !w.decided {
+		w.decided = true
+		h := w.Header()
+		if code == http.StatusOK && h.Get("Content-Encoding") == "" && h.Get("Content-Range") == "" && compressible(h.Get("Content-Type")) {
+			h.Add("Vary", "Accept-Encoding")
+			if acceptsEncoding(w.req, "gzip") {
+				length, err := strconv.Atoi(h.Get("Content-Length"))
+				switch {
+				case err == nil && length < compressMinBytes:
+				case err != nil && compressMinBytes > 0:
+					w.pending = code
+					return
+				default:
+					w.startGzip()
+				}
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *gzipResponseWriter) startGzip() {
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Del("Content-Length")
+	w.gz, _ = gzip.NewWriterLevel(w.ResponseWriter, gzipLevel)
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !w.decided {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.pending != 0 {
+		w.buf = append(w.buf, b...)
+		if len(w.buf) < compressMinBytes {
+			return len(b), nil
+		}
+		w.startGzip()
+		w.release()
+		if _, err := w.gz.Write(w.buf); err != nil {
+			return 0, err
+		}
+		w.buf = nil
+		return len(b), nil
+	}
+	if w.gz != nil {
+		return w.gz.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// release writes the held back status.
+func (w *gzipResponseWriter) release() {
+	w.ResponseWriter.WriteHeader(w.pending)
+	w.pending = 0
+}
+
+// finish sends a held back short body uncompressed, or ends the gzip stream.
+func (w *gzipResponseWriter) finish() {
+	if w.pending != 0 {
+		w.release()
+		w.ResponseWriter.Write(w.buf)
+		w.buf = nil
+	}
+	if w.gz != nil {
+		w.gz.Close()
+	}
+}
+
+// Flush sends a held back body uncompressed, as the handler wants it
+// delivered before it is known to reach compressMinBytes.
+func (w *gzipResponseWriter) Flush() {
+	if w.pending != 0 {
+		w.finish()
+	}
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func withGzip(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		w := &gzipResponseWriter{ResponseWriter: resp, req: req}
+		next.ServeHTTP(w, req)
+		w.finish()
+	})
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestOriginAllowed(t *testing.T) {
+	saved := corsOrigins
+	defer func() { corsOrigins = saved }()
+	corsOrigins = parseCORSOrigins(" https://Maps.example.com/, *.tiles.example.org, http://*.internal ,")
+
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"https://maps.example.com", true},
+		{"HTTPS://MAPS.EXAMPLE.COM", true},
+		{"http://maps.example.com", false},
+		{"https://maps.example.com.evil.net", false},
+		{"https://evil.net", false},
+		{"https://a.tiles.example.org", true},
+		{"http://a.b.tiles.example.org", true},
+		{"https://tiles.example.org", false},
+		{"https://eviltiles.example.org", false},
+		{"http://host.internal", true},
+		{"https://host.internal", false},
+		{"maps.example.com", false},
+		{"null", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := originAllowed(tt.origin); got != tt.want {
+			t.Errorf("originAllowed(%q) = %v, want %v", tt.origin, got, tt.want)
+		}
+	}
+}
+
+func TestAllowOrigin(t *testing.T) {
+	saved := corsOrigins
+	defer func() { corsOrigins = saved }()
+
+	tests := []struct {
+		name, origins, origin string
+		allow, vary           string
+	}{
+		{"wildcard without list", "", "https://evil.net", "*", ""},
+		{"wildcard without origin", "", "", "*", ""},
+		{"allowed", "https://maps.example.com", "https://maps.example.com", "https://maps.example.com", "Origin"},
+		{"allowed by pattern", "*.example.com", "https://a.example.com", "https://a.example.com", "Origin"},
+		{"disallowed", "https://maps.example.com", "https://evil.net", "", "Origin"},
+		{"no origin", "https://maps.example.com", "", "", "Origin"},
+	}
+	for _, tt := range tests {
+		corsOrigins = parseCORSOrigins(tt.origins)
+		req := httptest.NewRequest(http.MethodGet, "/osm/0/0/0.png", nil)
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+		resp := httptest.NewRecorder()
+		allowOrigin(resp, req)
+		if got := resp.Header().Get("Access-Control-Allow-Origin"); got != tt.allow {
+			t.Errorf("%s: Access-Control-Allow-Origin %q, want %q", tt.name, got, tt.allow)
+		}
+		if got := resp.Header().Get("Vary"); got != tt.vary {
+			t.Errorf("%s: Vary %q, want %q", tt.name, got, tt.vary)
+		}
+	}
+}
+
+func TestCanonicalPath(t *testing.T) {
+	dir := t.TempDir()
+	writeTestMBTiles(t, filepath.Join(dir, "osm.mbtiles"), map[string]string{"format": "png"},
+		map[[3]int][]byte{{0, 0, 0}: testPNG})
+	useDataDir(t, dir)
+	scanLayers()
+	saved := serveLayerIndex
+	defer func() { serveLayerIndex = saved }()
+
+	tests := []struct {
+		path       string
+		layerIndex bool
+		want       string
+	}{
+		{"/osm/0/0/0.png", false, "/osm/0/0/0.png"},
+		{"/osm/0/0/0.png/", false, "/osm/0/0/0.png"},
+		{"/osm//0/0//0.png", false, "/osm/0/0/0.png"},
+		{"//osm/0/0/0.png//", false, "/osm/0/0/0.png"},
+		{"/", false, "/"},
+		{"//", false, "/"},
+		{"/osm/", false, "/osm"},
+		{"/osm/", true, "/osm/"},
+		{"//osm//", true, "/osm/"},
+		{"/osm/3/", true, "/osm/3/"},
+		{"/unknown/", true, "/unknown"},
+	}
+	for _, tt := range tests {
+		serveLayerIndex = tt.layerIndex
+		if got := canonicalPath(tt.path); got != tt.want {
+			t.Errorf("canonicalPath(%q) with layer index %v = %q, want %q", tt.path, tt.layerIndex, got, tt.want)
+		}
+	}
+}
+
+func TestWithCanonicalPaths(t *testing.T) {
+	saved := slashMode
+	defer func() { slashMode = saved }()
+	var routed string
+	next := http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		routed = req.URL.Path
+	})
+
+	tests := []struct {
+		mode, method, target string
+		code                 int
+		routed, location     string
+	}{
+		{"strict", http.MethodGet, "/osm//0/0/0.png/", 200, "/osm//0/0/0.png/", ""},
+		{"serve", http.MethodGet, "/osm//0/0/0.png/", 200, "/osm/0/0/0.png", ""},
+		{"serve", http.MethodGet, "/osm/0/0/0.png", 200, "/osm/0/0/0.png", ""},
+		{"redirect", http.MethodGet, "/osm//0/0/0.png/?key=k", 301, "", "/osm/0/0/0.png?key=k"},
+		{"redirect", http.MethodHead, "/osm/0/0/0.png/", 301, "", "/osm/0/0/0.png"},
+		{"redirect", http.MethodPost, "/admin//reload", 308, "", "/admin/reload"},
+		{"redirect", http.MethodGet, "/osm/0/0/0.png", 200, "/osm/0/0/0.png", ""},
+		{"redirect", "TRACE", "/osm//0/0/0.png", 200, "/osm//0/0/0.png", ""},
+	}
+	for _, tt := range tests {
+		slashMode = tt.mode
+		routed = ""
+		resp := httptest.NewRecorder()
+		withCanonicalPaths(next).ServeHTTP(resp, httptest.NewRequest(tt.method, tt.target, nil))
+		if resp.Code != tt.code || routed != tt.routed {
+			t.Errorf("%s %s %s: status %d routed %q, want %d routed %q", tt.mode, tt.method, tt.target, resp.Code, routed, tt.code, tt.routed)
+		}
+		if got := resp.Header().Get("Location"); got != tt.location {
+			t.Errorf("%s %s %s: Location %q, want %q", tt.mode, tt.method, tt.target, got, tt.location)
+		}
+	}
+}
+
+// TestMethodNotAllowed checks that a path gets the same Allow whether the
+// method is rejected server-wide or by its route.
+func TestMethodNotAllowed(t *testing.T) {
+	saved := adminToken
+	defer func() { adminToken = saved }()
+	adminToken = "secret"
+
+	tests := []struct {
+		path, other, allow string
+	}{
+		{"/osm/0/0/0.png", http.MethodPost, "GET, HEAD, OPTIONS"},
+		{"/list", http.MethodPost, "GET, HEAD, OPTIONS"},
+		{"/osm/exists", http.MethodGet, "POST, OPTIONS"},
+		{"/admin/reload", http.MethodGet, "POST, OPTIONS"},
+		{"/admin/layers", http.MethodPost, "GET, HEAD, OPTIONS"},
+	}
+	for _, tt := range tests {
+		// PUT is rejected server-wide and the other method by the route.
+		for _, method := range []string{http.MethodPut, tt.other} {
+			resp := serveTest(method, tt.path, "Authorization: Bearer secret")
+			if resp.Code != http.StatusMethodNotAllowed {
+				t.Errorf("%s %s: status %d, want 405", method, tt.path, resp.Code)
+			}
+			if got := resp.Header().Get("Allow"); got != tt.allow {
+				t.Errorf("%s %s: Allow %q, want %q", method, tt.path, got, tt.allow)
+			}
+		}
+	}
+}
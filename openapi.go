@@ -0,0 +1,32 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+//go:embed openapi.json
+var openAPISpec []byte
+
+var serveOpenAPI bool
+
+// openAPIResponse serves the embedded OpenAPI description, leaving out
+// endpoints that are disabled by flags.
+func openAPIResponse(resp http.ResponseWriter, req *http.Request) {
+	var spec map[string]interface{}
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		http.Error(resp, "", 500)
+		return
+	}
+	paths, _ := spec["paths"].(map[string]interface{})
+	for path := range paths {
+		if adminToken == "" && strings.HasPrefix(path, "/admin/") || !serveMetrics && path == "/metrics" ||
+			!serveGeographic && strings.HasPrefix(path, "/4326/") ||
+			!debugHeaders && strings.HasSuffix(path, "/meta") || !serveLayerIndex && strings.HasSuffix(path, "/") && path != "/" {
+			delete(paths, path)
+		}
+	}
+	writeJSON(resp, req, spec)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// pinnedLayers names the layers whose file is copied into memory when it is
+// opened, and again whenever it changes, so that tiles never wait for disk.
+// mbtiles files become in-memory SQLite databases, and layers of pmtiles
+// archives are read from a byte slice. Tiles stored by -upstream-write-back
+// into a pinned layer only live in memory.
+var pinnedLayers = make(map[string]bool)
+
+var pinnedDatabases atomic.Int64
+
+// pinDatabase copies an SQLite file into a shared-cache in-memory database
+// and returns its pool. The database lives as long as the returned
+// connection, which must be closed before the pool.
+func pinDatabase(dataFile, filename string) (*sql.DB, *sql.Conn, error) {
+	start := time.Now()
+	ctx := context.Background()
+	db, err := sql.Open(sqliteDriver, fmt.Sprintf("file:pinned-%d?mode=memory&cache=shared", pinnedDatabases.Add(1)))
+	if err != nil {
+		return nil, nil, err
+	}
+	keeper, err := db.Conn(ctx)
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	if err = copyDatabase(ctx, keeper, dataFile); err != nil {
+		keeper.Close()
+		db.Close()
+		return nil, nil, fmt.Errorf("pinning in memory: %s", err)
+	}
+	var pages, pageSize int64
+	keeper.QueryRowContext(ctx, "PRAGMA page_count").Scan(&pages)
+	keeper.QueryRowContext(ctx, "PRAGMA page_size").Scan(&pageSize)
+	log.Printf("Pinned \"%s\" in memory: %.1f MiB in %s", filename, float64(pages*pageSize)/(1<<20),
+		time.Since(start).Round(time.Millisecond))
+	return db, keeper, nil
+}
+
+// copyDatabase copies the SQLite file with the backup API into the database
+// of dst.
+func copyDatabase(ctx context.Context, dst *sql.Conn, filename string) error {
+	src, err := sql.Open(sqliteDriver, sqliteDSN(filename))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	srcConn, err := src.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+	return dst.Raw(func(d interface{}) error {
+		return srcConn.Raw(func(s interface{}) error {
+			backup, err := d.(*sqlite3.SQLiteConn).Backup("main", s.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return err
+			}
+			if _, err := backup.Step(-1); err != nil {
+				backup.Finish()
+				return err
+			}
+			return backup.Finish()
+		})
+	})
+}
+
+// memoryFile serves a file read into memory to PMTiles.
+type memoryFile struct {
+	*bytes.Reader
+}
+
+func (memoryFile) Close() error {
+	return nil
+}
+
+func readPinnedFile(dataFile, filename string) (memoryFile, error) {
+	start := time.Now()
+	data, err := os.ReadFile(dataFile)
+	if err != nil {
+		return memoryFile{}, err
+	}
+	log.Printf("Pinned \"%s\" in memory: %.1f MiB in %s", filename, float64(len(data))/(1<<20),
+		time.Since(start).Round(time.Millisecond))
+	return memoryFile{bytes.NewReader(data)}, nil
+}
+
+// closeConn closes the SQLite pool of the layer, and the connection keeping
+// its in-memory copy if it is pinned.
+func (layer *Layer) closeConn() error {
+	if layer.pinConn != nil {
+		layer.pinConn.Close()
+	}
+	return layer.conn.Close()
+}
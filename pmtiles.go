@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// PMTiles reads tiles from a PMTiles version 3 archive.
+// See https://github.com/protomaps/PMTiles/blob/main/spec/v3/spec.md
+type PMTiles struct {
+	file   pmtilesFile
+	header pmtilesHeader
+	root   []pmtilesEntry
+}
+
+const pmtilesHeaderLen = 127
+
+// Compression and tile type codes from the PMTiles header.
+const (
+	pmtilesCompressionNone   = 1
+	pmtilesCompressionGzip   = 2
+	pmtilesCompressionBrotli = 3
+	pmtilesCompressionZstd   = 4
+)
+
+var pmtilesFormats = map[uint8]string{1: "pbf", 2: "png", 3: "jpg", 4: "webp", 5: "avif"}
+
+var pmtilesEncodings = map[uint8]string{
+	pmtilesCompressionGzip:   "gzip",
+	pmtilesCompressionBrotli: "br",
+	pmtilesCompressionZstd:   "zstd",
+}
+
+type pmtilesHeader struct {
+	rootOffset, rootLength         uint64
+	metadataOffset, metadataLength uint64
+	leafOffset, leafLength         uint64
+	dataOffset, dataLength         uint64
+	internalCompression            uint8
+	tileCompression                uint8
+	tileType                       uint8
+	minZoom, maxZoom               uint8
+	minLon, minLat, maxLon, maxLat int32
+	centerZoom                     uint8
+	centerLon, centerLat           int32
+}
+
+type pmtilesFile interface {
+	io.ReaderAt
+	io.Closer
+}
+
+type pmtilesEntry struct {
+	tileID    uint64
+	offset    uint64
+	length    uint32
+	runLength uint32
+}
+
+func openPMTiles(file pmtilesFile) (*PMTiles, error) {
+	p := &PMTiles{file: file}
+	if err := p.readHeader(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	var err error
+	if p.root, err = p.readDirectory(p.header.rootOffset, p.header.rootLength); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("reading root directory: %s", err)
+	}
+	return p, nil
+}
+
+func (p *PMTiles) Close() error {
+	return p.file.Close()
+}
+
+func (p *PMTiles) readHeader() error {
+	buf := make([]byte, pmtilesHeaderLen)
+	if _, err := p.file.ReadAt(buf, 0); err != nil {
+		return err
+	}
+	if !bytes.Equal(buf[:7], []byte("PMTiles")) || buf[7] != 3 {
+		return fmt.Errorf("not a PMTiles v3 file")
+	}
+	le := binary.LittleEndian
+	h := &p.header
+	h.rootOffset, h.rootLength = le.Uint64(buf[8:]), le.Uint64(buf[16:])
+	h.metadataOffset, h.metadataLength = le.Uint64(buf[24:]), le.Uint64(buf[32:])
+	h.leafOffset, h.leafLength = le.Uint64(buf[40:]), le.Uint64(buf[48:])
+	h.dataOffset, h.dataLength = le.Uint64(buf[56:]), le.Uint64(buf[64:])
+	h.internalCompression, h.tileCompression, h.tileType = buf[97], buf[98], buf[99]
+	h.minZoom, h.maxZoom = buf[100], buf[101]
+	h.minLon, h.minLat = int32(le.Uint32(buf[102:])), int32(le.Uint32(buf[106:]))
+	h.maxLon, h.maxLat = int32(le.Uint32(buf[110:])), int32(le.Uint32(buf[114:]))
+	h.centerZoom = buf[118]
+	h.centerLon, h.centerLat = int32(le.Uint32(buf[119:])), int32(le.Uint32(buf[123:]))
+	return nil
+}
+
+// readInternal reads a directory or metadata section and undoes its internal
+// compression.
+func (p *PMTiles) readInternal(offset, length uint64) ([]byte, error) {
+	buf := make([]byte, length)
+	if _, err := p.file.ReadAt(buf, int64(offset)); err != nil {
+		return nil, err
+	}
+	switch p.header.internalCompression {
+	case pmtilesCompressionNone:
+		return buf, nil
+	case pmtilesCompressionGzip:
+		return gunzip(buf)
+	}
+	return nil, fmt.Errorf("unsupported internal compression %d", p.header.internalCompression)
+}
+
+func (p *PMTiles) readDirectory(offset, length uint64) ([]pmtilesEntry, error) {
+	data, err := p.readInternal(offset, length)
+	if err != nil {
+		return nil, err
+	}
+	r := bytes.NewReader(data)
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(len(data)) {
+		return nil, fmt.Errorf("directory entry count %d exceeds its size", n)
+	}
+	entries := make([]pmtilesEntry, n)
+	var lastID uint64
+	for i := range entries {
+		v, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		lastID += v
+		entries[i].tileID = lastID
+	}
+	for i := range entries {
+		v, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		entries[i].runLength = uint32(v)
+	}
+	for i := range entries {
+		v, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		entries[i].length = uint32(v)
+	}
+	for i := range entries {
+		v, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		if v == 0 && i > 0 {
+			entries[i].offset = entries[i-1].offset + uint64(entries[i-1].length)
+		} else {
+			entries[i].offset = v - 1
+		}
+	}
+	return entries, nil
+}
+
+func (p *PMTiles) metadata() (map[string]string, json.RawMessage, error) {
+	metadata := map[string]string{
+		"format":  pmtilesFormats[p.header.tileType],
+		"minzoom": strconv.Itoa(int(p.header.minZoom)),
+		"maxzoom": strconv.Itoa(int(p.header.maxZoom)),
+		"bounds": fmt.Sprintf("%g,%g,%g,%g", float64(p.header.minLon)/1e7, float64(p.header.minLat)/1e7,
+			float64(p.header.maxLon)/1e7, float64(p.header.maxLat)/1e7),
+		"center": fmt.Sprintf("%g,%g,%d", float64(p.header.centerLon)/1e7, float64(p.header.centerLat)/1e7,
+			p.header.centerZoom),
+	}
+	if p.header.metadataLength == 0 {
+		return metadata, nil, nil
+	}
+	data, err := p.readInternal(p.header.metadataOffset, p.header.metadataLength)
+	if err != nil {
+		return metadata, nil, err
+	}
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return metadata, nil, err
+	}
+	for key, value := range doc {
+		var s string
+		if json.Unmarshal(value, &s) == nil {
+			metadata[key] = s
+		}
+	}
+	return metadata, doc["vector_layers"], nil
+}
+
+// find locates tile data for TMS coordinates, as used in tile URLs.
+func (p *PMTiles) find(x, y, z int) (offset uint64, length uint32, found bool, err error) {
+	if z < 0 || z > 31 || x < 0 || y < 0 || x >= 1<<uint(z) || y >= 1<<uint(z) {
+		return 0, 0, false, nil
+	}
+	id := pmtilesTileID(uint8(z), uint32(x), uint32((1<<uint(z))-1-y))
+	entries := p.root
+	for depth := 0; depth < 4; depth++ {
+		i := sort.Search(len(entries), func(i int) bool { return entries[i].tileID > id }) - 1
+		if i < 0 {
+			return 0, 0, false, nil
+		}
+		entry := entries[i]
+		if entry.runLength > 0 {
+			if id-entry.tileID >= uint64(entry.runLength) || entry.length == 0 && !serveEmptyTiles {
+				return 0, 0, false, nil
+			}
+			return p.header.dataOffset + entry.offset, entry.length, true, nil
+		}
+		entries, err = p.readDirectory(p.header.leafOffset+entry.offset, uint64(entry.length))
+		if err != nil {
+			return 0, 0, false, err
+		}
+	}
+	return 0, 0, false, fmt.Errorf("directory nesting too deep")
+}
+
+func (p *PMTiles) tile(x, y, z int) ([]byte, error) {
+	r, err := p.reader(x, y, z)
+	if err != nil || r == nil {
+		return nil, err
+	}
+	data := make([]byte, r.Size())
+	if _, err := r.ReadAt(data, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return data, nil
+}
+
+// reader returns a reader of the tile data in the archive, so that it can be
+// sent without loading it into memory, or nil if the tile does not exist.
+func (p *PMTiles) reader(x, y, z int) (*io.SectionReader, error) {
+	offset, length, found, err := p.find(x, y, z)
+	if err != nil || !found {
+		return nil, err
+	}
+	if maxTileBytes > 0 && int64(length) > maxTileBytes {
+		return nil, errTileTooLarge
+	}
+	return io.NewSectionReader(p.file, int64(offset), int64(length)), nil
+}
+
+// streamTileResponse sends a PMTiles tile straight from the file. It is used
+// when the tile needs no processing: the format is known from the header, no
+// watermark is applied and the client accepts the stored encoding. SQLite
+// tiles are always buffered, as the driver has no incremental blob reads.
+func streamTileResponse(resp http.ResponseWriter, req *http.Request, layer *Layer, name string, x, y, z int) {
+	start := time.Now()
+	r, err := layer.pmtiles.reader(x, y, z)
+	logSlowTile(name, z, x, y, time.Since(start))
+	layer.recordError(err)
+	setDebugHeaders(resp, layer, "pmtiles")
+	if err != nil {
+		logTileError("Error getting tile", name, z, x, y, err)
+		tileErrorResponse(resp, err)
+		return
+	}
+	if r == nil {
+		logMissingTile(name, z, x, y)
+		http.NotFound(resp, req)
+		return
+	}
+	if layer.formatEncoding != "" {
+		resp.Header().Add("Vary", "Accept-Encoding")
+		resp.Header().Add("Content-Encoding", layer.formatEncoding)
+	}
+	resp.Header().Add("Content-Type", layer.formatType)
+	layer.dims.setHeaders(resp, layer.formatType, io.NewSectionReader(r, 0, r.Size()))
+	resp.Header().Set("ETag", layer.weakETag())
+	w := &writeErrorRecorder{ResponseWriter: resp}
+	http.ServeContent(w, req, "", layer.mtime, r)
+	flushTile(resp)
+	logWriteError(name, z, x, y, w.err)
+}
+
+// pmtilesTileID maps XYZ coordinates to a tile ID along the Hilbert curve of
+// its zoom level, offset by the number of tiles in all lower zoom levels.
+func pmtilesTileID(z uint8, x, y uint32) uint64 {
+	id := pmtilesZoomStart(int(z))
+	n := uint64(1) << z
+	tx, ty := uint64(x), uint64(y)
+	for s := n / 2; s > 0; s /= 2 {
+		var rx, ry uint64
+		if tx&s != 0 {
+			rx = 1
+		}
+		if ty&s != 0 {
+			ry = 1
+		}
+		id += s * s * ((3 * rx) ^ ry)
+		if ry == 0 {
+			if rx == 1 {
+				tx, ty = n-1-tx, n-1-ty
+			}
+			tx, ty = ty, tx
+		}
+	}
+	return id
+}
+
+func (layer *Layer) openPMTiles(filename string) (err error) {
+	if layer.config, err = loadLayerConfig(filename); err != nil {
+		return
+	}
+	var file pmtilesFile
+	if pinnedLayers[layer.name] {
+		file, err = readPinnedFile(layer.dataFile, filename)
+	} else {
+		file, err = os.Open(layer.dataFile)
+	}
+	if err != nil {
+		return
+	}
+	if layer.pmtiles, err = openPMTiles(file); err != nil {
+		return
+	}
+	layer.metadata, layer.vectorLayers, err = layer.pmtiles.metadata()
+	if err != nil {
+		log.Printf("Error reading metadata from \"%s\": %s", filename, err)
+	}
+	layer.formatType = formatContentTypes[pmtilesFormats[layer.pmtiles.header.tileType]]
+	if layer.config.ContentType != "" {
+		layer.formatType = layer.config.ContentType
+	}
+	layer.formatEncoding = pmtilesEncodings[layer.pmtiles.header.tileCompression]
+	return nil
+}
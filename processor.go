@@ -0,0 +1,33 @@
+package main
+
+// TileProcessor transforms tiles of the main tile route after they are read
+// and watermarked, and before they are cached and sent. Cached tiles are the
+// processed ones, so Process runs once per tile while it stays in the cache.
+//
+// contentType is the detected content type of data, which is the stored
+// tile and may be gzip-compressed for vector layers; the result must keep
+// that encoding. Process returns the new data and content type, and an error
+// to answer the request with 500.
+type TileProcessor interface {
+	Process(layer string, z, x, y int, contentType string, data []byte) ([]byte, string, error)
+}
+
+// NoopProcessor returns tiles unchanged.
+type NoopProcessor struct{}
+
+func (NoopProcessor) Process(layer string, z, x, y int, contentType string, data []byte) ([]byte, string, error) {
+	return data, contentType, nil
+}
+
+var tileProcessor TileProcessor = NoopProcessor{}
+
+// RegisterTileProcessor installs p. It is meant to be called from init() of
+// a file added to the build, e.g. one guarded by a build tag.
+func RegisterTileProcessor(p TileProcessor) {
+	tileProcessor = p
+}
+
+func hasTileProcessor() bool {
+	_, noop := tileProcessor.(NoopProcessor)
+	return !noop
+}
@@ -0,0 +1,48 @@
+package main
+
+import "context"
+
+// TileReader reads the tiles of an mbtiles layer, for files that do not store
+// one tile per row, e.g. several tiles packed into a blob with an index. The
+// reader of a layer is named by the "reader" key of its sidecar config, and is
+// "standard" by default.
+//
+// ReadTile gets the row as stored in the file, after the row transform of the
+// layer config, and returns nil for missing tiles. The file and its config
+// are layer.conn and layer.config. The tiles table of the config is still
+// checked when the layer is opened, but existence checks and tile sizes of
+// layers with a custom reader go through ReadTile, and presence indexes are
+// not used for them.
+type TileReader interface {
+	ReadTile(ctx context.Context, layer *Layer, x, y, z int) ([]byte, error)
+}
+
+// StandardReader reads a tile from its row of the tiles table.
+type StandardReader struct{}
+
+func (StandardReader) ReadTile(ctx context.Context, layer *Layer, x, y, z int) ([]byte, error) {
+	if layer.index != nil && !layer.index.has(x, y, z) {
+		return nil, nil
+	}
+	return layer.retryQuery(ctx, layer.tileStmt, x, y, z)
+}
+
+var tileReaders = map[string]TileReader{"standard": StandardReader{}}
+
+// RegisterTileReader makes r available to layer configs as name. Like
+// RegisterTileProcessor it is meant to be called from init() of a file added
+// to the build:
+//
+//	func init() {
+//		RegisterTileReader("packed", packedReader{})
+//	}
+func RegisterTileReader(name string, r TileReader) {
+	tileReaders[name] = r
+}
+
+// customReader reports whether the tiles of an mbtiles layer are read by a
+// registered reader instead of StandardReader.
+func (layer *Layer) customReader() bool {
+	_, standard := layer.reader.(StandardReader)
+	return layer.pmtiles == nil && !standard
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"archive/zip"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const maxLatitude = 85.0511287798
+
+var regionMaxTiles int
+
+type bbox struct {
+	minLon, minLat, maxLon, maxLat float64
+}
+
+func parseBbox(s string) (b bbox, err error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return b, fmt.Errorf("bbox must have 4 comma-separated values")
+	}
+	var v [4]float64
+	for i, part := range parts {
+		v[i], err = strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return b, fmt.Errorf("invalid bbox value \"%s\"", part)
+		}
+	}
+	b = bbox{v[0], v[1], v[2], v[3]}
+	if b.minLon > b.maxLon || b.minLat > b.maxLat {
+		return b, fmt.Errorf("bbox min values must not exceed max values")
+	}
+	return b, nil
+}
+
+func (b bbox) intersect(other bbox) (bbox, bool) {
+	r := bbox{
+		math.Max(b.minLon, other.minLon), math.Max(b.minLat, other.minLat),
+		math.Min(b.maxLon, other.maxLon), math.Min(b.maxLat, other.maxLat),
+	}
+	return r, r.minLon <= r.maxLon && r.minLat <= r.maxLat
+}
+
+func lonToTileX(lon float64, z int) int {
+	n := float64(int(1) << uint(z))
+	x := int(math.Floor((lon + 180) / 360 * n))
+	return clampTile(x, z)
+}
+
+// latToTileRow returns the TMS row, which is how rows are stored and served.
+func latToTileRow(lat float64, z int) int {
+	lat = math.Max(-maxLatitude, math.Min(maxLatitude, lat)) * math.Pi / 180
+	n := float64(int(1) << uint(z))
+	y := int(math.Floor((1 - math.Log(math.Tan(lat)+1/math.Cos(lat))/math.Pi) / 2 * n))
+	return (1 << uint(z)) - 1 - clampTile(y, z)
+}
+
+func clampTile(v, z int) int {
+	if v < 0 {
+		return 0
+	}
+	if max := (1 << uint(z)) - 1; v > max {
+		return max
+	}
+	return v
+}
+
+func (layer *Layer) zoomRange() (minZoom, maxZoom int) {
+	minZoom, maxZoom = 0, 22
+	if v, err := strconv.Atoi(layer.metadata["minzoom"]); err == nil {
+		minZoom = v
+	}
+	if v, err := strconv.Atoi(layer.metadata["maxzoom"]); err == nil {
+		maxZoom = v
+	}
+	return
+}
+
+// urlZoomRange is the zoom range of tile URLs: that of the file, shifted by
+// the zoom offset of the layer config.
+func (layer *Layer) urlZoomRange() (minZoom, maxZoom int) {
+	minZoom, maxZoom = layer.zoomRange()
+	minZoom, maxZoom = minZoom-layer.config.ZoomOffset, maxZoom-layer.config.ZoomOffset
+	if minZoom < 0 {
+		minZoom = 0
+	}
+	return
+}
+
+func (layer *Layer) bounds() bbox {
+	if b, err := parseBbox(layer.metadata["bounds"]); err == nil {
+		return b
+	}
+	return bbox{-180, -maxLatitude, 180, maxLatitude}
+}
+
+func (layer *Layer) extension() string {
+	switch format := layer.metadata["format"]; format {
+	case "jpg", "jpeg":
+		return "jpg"
+	case "webp", "pbf":
+		return format
+	}
+	return "png"
+}
+
+// anyExtension disables the check of tile URL extensions against the layer
+// format, for files whose tiles do not all match their metadata.
+var anyExtension bool
+
+// allowsExtension reports whether tiles of the layer may be requested with
+// the ext URL extension. Layers of unknown format accept any extension.
+func (layer *Layer) allowsExtension(ext string) bool {
+	if anyExtension || layer.metadata["format"] == "" {
+		return true
+	}
+	if ext == "jpeg" {
+		ext = "jpg"
+	}
+	return ext == layer.extension()
+}
+
+// tileRange is a rectangle of tiles in the coordinates of tile URLs, which
+// are also those of the zip entries.
+type tileRange struct {
+	z, minX, maxX, minY, maxY int
+}
+
+func regionResponse(resp http.ResponseWriter, req *http.Request) {
+	allowOrigin(resp, req)
+	urlFields := layerPathFields(req.URL.Path)
+	if len(urlFields) != 3 {
+		http.NotFound(resp, req)
+		return
+	}
+	name := urlFields[1]
+	layer := acquireRequestLayer(resp, req, name)
+	if layer == nil {
+		return
+	}
+	defer layer.activeRequests.Done()
+	if !layer.valid {
+		http.Error(resp, "layer invalid", 500)
+		return
+	}
+	query := req.URL.Query()
+	area, err := parseBbox(query.Get("bbox"))
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+	minZoom, maxZoom := layer.urlZoomRange()
+	if v := query.Get("minzoom"); v != "" {
+		z, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(resp, "invalid minzoom", http.StatusBadRequest)
+			return
+		}
+		if z > minZoom {
+			minZoom = z
+		}
+	}
+	if v := query.Get("maxzoom"); v != "" {
+		z, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(resp, "invalid maxzoom", http.StatusBadRequest)
+			return
+		}
+		if z < maxZoom {
+			maxZoom = z
+		}
+	}
+	area, ok := area.intersect(layer.bounds())
+	if !ok || minZoom > maxZoom {
+		http.Error(resp, "region does not intersect layer", http.StatusBadRequest)
+		return
+	}
+
+	var ranges []tileRange
+	total := 0
+	for z := minZoom; z <= maxZoom; z++ {
+		if !layer.config.servesZoom(z) {
+			continue
+		}
+		r := tileRange{
+			z:    z,
+			minX: lonToTileX(area.minLon, z), maxX: lonToTileX(area.maxLon, z),
+			minY: latToTileRow(area.minLat, z), maxY: latToTileRow(area.maxLat, z),
+		}
+		total += (r.maxX - r.minX + 1) * (r.maxY - r.minY + 1)
+		if total > regionMaxTiles {
+			http.Error(resp, fmt.Sprintf("region exceeds %d tiles", regionMaxTiles), http.StatusBadRequest)
+			return
+		}
+		ranges = append(ranges, r)
+	}
+
+	resp.Header().Set("Content-Type", "application/zip")
+	resp.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.zip\"", name))
+	w := &sentWriter{ResponseWriter: resp}
+	archive := zip.NewWriter(w)
+	ext := layer.extension()
+	for _, r := range ranges {
+		if err := layer.writeRange(archive, r, ext); err != nil {
+			log.Printf("Error writing region of layer \"%s\" z=%d: %v", name, r.z, err)
+			abortRegion(w)
+			return
+		}
+	}
+	if err := archive.Close(); err != nil {
+		log.Printf("Error writing region of layer \"%s\": %v", name, err)
+		abortRegion(w)
+	}
+}
+
+// sentWriter records whether any of the response body has been written.
+type sentWriter struct {
+	http.ResponseWriter
+	sent bool
+}
+
+func (w *sentWriter) Write(b []byte) (int, error) {
+	w.sent = true
+	return w.ResponseWriter.Write(b)
+}
+
+// abortRegion ends a failed region download. Closing the archive would write
+// its central directory, making a truncated archive look complete, so once
+// some of it is sent the connection is aborted instead.
+func abortRegion(w *sentWriter) {
+	if w.sent {
+		panic(http.ErrAbortHandler)
+	}
+	w.Header().Del("Content-Type")
+	w.Header().Del("Content-Disposition")
+	http.Error(w, "", 500)
+}
+
+func (layer *Layer) writeRange(archive *zip.Writer, r tileRange, ext string) error {
+	if layer.pmtiles != nil {
+		return layer.writePMTilesRange(archive, r, ext)
+	}
+	// The row transform maps the rows of the range to a range of stored rows,
+	// reversed if it flips them. Stored rows outside the zoom level are not
+	// served, as on the tile route.
+	minRow, _ := layer.config.Rows.storedRow(r.minY, r.z)
+	maxRow, _ := layer.config.Rows.storedRow(r.maxY, r.z)
+	if minRow > maxRow {
+		minRow, maxRow = maxRow, minRow
+	}
+	if maxRow < 0 || minRow >= 1<<uint(r.z) {
+		return nil
+	}
+	minRow, maxRow = clampTile(minRow, r.z), clampTile(maxRow, r.z)
+	c := layer.config.Columns
+	rows, err := layer.conn.Query(fmt.Sprintf("SELECT %s, %s, %s FROM %s "+
+		"WHERE %s=? AND %s BETWEEN ? AND ? AND %s BETWEEN ? AND ?",
+		quoteIdent(c.Column), quoteIdent(c.Row), tileDataColumns(c), c.from(),
+		quoteIdent(c.Zoom), quoteIdent(c.Column), quoteIdent(c.Row)),
+		r.z+layer.config.ZoomOffset, r.minX, r.maxX, minRow, maxRow)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var x, stored int
+		var size sql.NullInt64
+		var data []byte
+		if err := rows.Scan(&x, &stored, &size, &data); err != nil {
+			return err
+		}
+		y := layer.config.Rows.tmsRow(stored, r.z)
+		if ok, err := tileSizeAllowed(size.Int64); !ok {
+			if err != nil {
+				logTileError("Error reading tile", layer.name, r.z, x, y, err)
+			}
+			continue
+		}
+		if err := layer.writeZipTile(archive, r.z, x, y, ext, data); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (layer *Layer) writePMTilesRange(archive *zip.Writer, r tileRange, ext string) error {
+	for x := r.minX; x <= r.maxX; x++ {
+		for y := r.minY; y <= r.maxY; y++ {
+			stored, storedZ, ok := layer.storedTile(x, y, r.z)
+			if !ok {
+				continue
+			}
+			data, err := layer.pmtiles.tile(x, stored, storedZ)
+			if errors.Is(err, errTileTooLarge) {
+				logTileError("Error reading tile", layer.name, r.z, x, y, err)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if data == nil {
+				continue
+			}
+			if err := layer.writeZipTile(archive, r.z, x, y, ext, data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (layer *Layer) writeZipTile(archive *zip.Writer, z, x, y int, ext string, data []byte) error {
+	w, err := archive.CreateHeader(&zip.FileHeader{
+		Name:     fmt.Sprintf("%d/%d/%d.%s", z, x, y, ext),
+		Method:   zip.Store,
+		Modified: layer.mtime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
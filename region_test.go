@@ -0,0 +1,58 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// TestRegionTileFilter checks that region downloads leave out the tiles the
+// tile route does not serve: zero-length ones without -serve-empty-tiles and
+// those over -max-tile-bytes.
+func TestRegionTileFilter(t *testing.T) {
+	large := append(append([]byte{}, testPNG...), make([]byte, 64)...)
+	dir := t.TempDir()
+	writeTestMBTiles(t, filepath.Join(dir, "r.mbtiles"), map[string]string{"format": "png", "minzoom": "0", "maxzoom": "1"},
+		map[[3]int][]byte{{0, 0, 0}: testPNG, {1, 0, 0}: {}, {1, 1, 0}: large, {1, 1, 1}: testPNG})
+	useDataDir(t, dir)
+	scanLayers()
+	savedEmpty, savedMax, savedRegionMax := serveEmptyTiles, maxTileBytes, regionMaxTiles
+	defer func() { serveEmptyTiles, maxTileBytes, regionMaxTiles = savedEmpty, savedMax, savedRegionMax }()
+	regionMaxTiles = 100
+
+	tests := []struct {
+		name  string
+		empty bool
+		max   int64
+		want  []string
+	}{
+		{"defaults", false, 1 << 20, []string{"0/0/0.png", "1/1/0.png", "1/1/1.png"}},
+		{"max tile bytes", false, 16, []string{"0/0/0.png", "1/1/1.png"}},
+		{"serve empty tiles", true, 16, []string{"0/0/0.png", "1/0/0.png", "1/1/1.png"}},
+	}
+	for _, tt := range tests {
+		serveEmptyTiles, maxTileBytes = tt.empty, tt.max
+		resp := serveTest(http.MethodGet, "/r/region?bbox=-180,-85,180,85")
+		if resp.Code != http.StatusOK {
+			t.Errorf("%s: status %d: %s", tt.name, resp.Code, resp.Body.Bytes())
+			continue
+		}
+		archive, err := zip.NewReader(bytes.NewReader(resp.Body.Bytes()), int64(resp.Body.Len()))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		var names []string
+		for _, f := range archive.File {
+			names = append(names, f.Name)
+		}
+		sort.Strings(names)
+		if !reflect.DeepEqual(names, tt.want) {
+			t.Errorf("%s: entries %v, want %v", tt.name, names, tt.want)
+		}
+	}
+}
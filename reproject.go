@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	_ "image/jpeg"
+	"image/png"
+	"math"
+	"net/http"
+	"strings"
+)
+
+// serveGeographic enables the /4326/{layer}/{z}/{x}/{y} route, which serves
+// raster layers resampled into the WorldCRS84Quad tile matrix.
+var serveGeographic bool
+
+// geographicCache keeps reprojected tiles, as producing one decodes up to a
+// few source tiles and encodes a new PNG.
+var geographicCache *TileCache
+
+const reprojectTileSize = 256
+
+// maxMercatorLat is the latitude at which Web Mercator tiles end.
+var maxMercatorLat = math.Atan(math.Sinh(math.Pi)) * 180 / math.Pi
+
+// geographicResponse serves a tile of the EPSG:4326 WorldCRS84Quad matrix,
+// which has 2 columns and 1 row at zoom 0, each tile covering 180 degrees.
+// As on the main tile route, rows are counted from the bottom.
+//
+// Every output pixel takes the colour of the nearest pixel of the Web
+// Mercator tiles one zoom level up, which have about the same resolution at
+// the equator. There is no interpolation, so tiles look blocky further from
+// the equator where Mercator stretches, and thin lines may be dropped or
+// doubled. Areas beyond the Mercator latitude limit of about 85 degrees, and
+// the source tiles that are missing, are left transparent. The result is
+// always PNG, regardless of the source format.
+func geographicResponse(resp http.ResponseWriter, req *http.Request) {
+	allowOrigin(resp, req)
+	urlFields := layerPathFields(strings.TrimPrefix(req.URL.Path, "/4326"))
+	if len(urlFields) != 5 {
+		http.NotFound(resp, req)
+		return
+	}
+	name := urlFields[1]
+	layer := acquireRequestLayer(resp, req, name)
+	if layer == nil {
+		return
+	}
+	defer layer.activeRequests.Done()
+	if !layer.valid {
+		http.Error(resp, "layer invalid", 500)
+		return
+	}
+	if layer.config.SRS != "EPSG:3857" || (layer.formatType != "image/png" && layer.formatType != "image/jpeg") {
+		http.Error(resp, "layer can not be reprojected", http.StatusNotFound)
+		return
+	}
+	z, x, y, err := parseTileCoords(urlFields[2], urlFields[3], urlFields[4])
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if z < 0 || z > 30 || x < 0 || y < 0 || x >= 2<<uint(z) || y >= 1<<uint(z) {
+		http.NotFound(resp, req)
+		return
+	}
+	key := tileKey{layer, "", 1, x, y, z}
+	data, _, cached := geographicCache.get(key)
+	if !cached {
+		data, err = layer.geographicTile(req.Context(), x, y, z)
+		if err != nil {
+			logTileError("Error reprojecting tile", name, z, x, y, err)
+			http.Error(resp, "", 500)
+			return
+		}
+		geographicCache.put(key, data, "")
+	}
+	if data == nil {
+		http.NotFound(resp, req)
+		return
+	}
+	resp.Header().Set("Content-Type", "image/png")
+	http.ServeContent(resp, req, "", layer.mtime, bytes.NewReader(data))
+}
+
+// geographicTile renders the WorldCRS84Quad tile at x, y (from the bottom)
+// and z, or returns nil if none of its source tiles exist.
+func (layer *Layer) geographicTile(ctx context.Context, x, y, z int) ([]byte, error) {
+	minZoom, maxZoom := layer.urlZoomRange()
+	sourceZoom := z + 1
+	if sourceZoom > maxZoom {
+		sourceZoom = maxZoom
+	}
+	if sourceZoom < minZoom {
+		sourceZoom = minZoom
+	}
+	n := 1 << uint(sourceZoom)
+	worldSize := float64(n * reprojectTileSize)
+	degrees := 180 / float64(int(1)<<uint(z)) / reprojectTileSize
+	west := float64(x)*180/float64(int(1)<<uint(z)) - 180
+	north := float64(y+1)*180/float64(int(1)<<uint(z)) - 90
+
+	sources := make(map[image.Point]image.Image)
+	source := func(tx, ty int) (image.Image, error) {
+		p := image.Pt(tx, ty)
+		if img, ok := sources[p]; ok {
+			return img, nil
+		}
+		var data []byte
+		var err error
+		if stored, storedZ, ok := layer.storedTile(tx, n-1-ty, sourceZoom); ok {
+			data, err = layer.tile(ctx, tx, stored, storedZ)
+		}
+		if err != nil || data == nil {
+			sources[p] = nil
+			return nil, err
+		}
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if img.Bounds().Dx() != reprojectTileSize || img.Bounds().Dy() != reprojectTileSize {
+			// Resample other tile sizes to the grid the pixel maths assumes.
+			scaled := image.NewRGBA(image.Rect(0, 0, reprojectTileSize, reprojectTileSize))
+			for py := 0; py < reprojectTileSize; py++ {
+				for px := 0; px < reprojectTileSize; px++ {
+					b := img.Bounds()
+					scaled.Set(px, py, img.At(b.Min.X+px*b.Dx()/reprojectTileSize, b.Min.Y+py*b.Dy()/reprojectTileSize))
+				}
+			}
+			img = scaled
+		}
+		sources[p] = img
+		return img, nil
+	}
+
+	canvas := image.NewRGBA(image.Rect(0, 0, reprojectTileSize, reprojectTileSize))
+	found := false
+	for py := 0; py < reprojectTileSize; py++ {
+		lat := north - (float64(py)+0.5)*degrees
+		if lat >= maxMercatorLat || lat <= -maxMercatorLat {
+			continue
+		}
+		sin := math.Sin(lat * math.Pi / 180)
+		my := (0.5 - math.Log((1+sin)/(1-sin))/(4*math.Pi)) * worldSize
+		for px := 0; px < reprojectTileSize; px++ {
+			lon := west + (float64(px)+0.5)*degrees
+			mx := (lon + 180) / 360 * worldSize
+			gx, gy := int(mx), int(my)
+			if gx >= int(worldSize) {
+				gx = int(worldSize) - 1
+			}
+			img, err := source(gx/reprojectTileSize, gy/reprojectTileSize)
+			if err != nil {
+				return nil, err
+			}
+			if img == nil {
+				continue
+			}
+			found = true
+			b := img.Bounds()
+			canvas.Set(px, py, img.At(b.Min.X+gx%reprojectTileSize, b.Min.Y+gy%reprojectTileSize))
+		}
+	}
+	if !found {
+		return nil, nil
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, canvas); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+)
+
+// maxTileScale caps the ?scale= parameter, as upscaled tiles grow with its
+// square. At 1, scaling is disabled.
+var maxTileScale = 4
+
+// retinaTable is the table holding tiles rendered at twice the resolution,
+// served for ?scale=2 instead of upscaling.
+const retinaTable = "tiles_2x"
+
+// scaledCache keeps upscaled tiles, which are costly to produce. It is nil
+// when scaling is disabled.
+var scaledCache *TileCache
+
+// scaledTileResponse serves a raster tile at scale times its resolution for
+// high-DPI displays.
+func scaledTileResponse(resp http.ResponseWriter, req *http.Request, layer *Layer, name string, x, y, z, scale int) {
+	if layer.formatType != "image/png" && layer.formatType != "image/jpeg" {
+		http.Error(resp, "scale is only supported for PNG and JPEG layers", http.StatusBadRequest)
+		return
+	}
+	key := tileKey{layer, "", scale, x, y, z}
+	data, _, cached := scaledCache.get(key)
+	if cached {
+		setDebugHeaders(resp, layer, "cache")
+	} else {
+		ctx := req.Context()
+		if tileTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, tileTimeout)
+			defer cancel()
+		}
+		var err error
+		data, err = layer.scaledTile(ctx, x, y, z, scale)
+		setDebugHeaders(resp, layer, layer.tileSource())
+		if err != nil && ctx.Err() == context.DeadlineExceeded {
+			logTileError("Timeout getting tile", name, z, x, y, err)
+			http.Error(resp, "", http.StatusGatewayTimeout)
+			return
+		}
+		if err != nil {
+			logTileError("Error scaling tile", name, z, x, y, err)
+			http.Error(resp, "", 500)
+			return
+		}
+		scaledCache.put(key, data, "")
+	}
+	if data == nil {
+		http.NotFound(resp, req)
+		return
+	}
+	contentType, _ := sniffTile(data)
+	resp.Header().Add("Content-Type", contentType)
+	http.ServeContent(resp, req, "", layer.mtime, bytes.NewReader(data))
+}
+
+// scaledTile returns the tile from the retina table for scale 2 if the file
+// has one, and the tile upscaled by pixel replication otherwise.
+func (layer *Layer) scaledTile(ctx context.Context, x, y, z, scale int) ([]byte, error) {
+	if scale == 2 && layer.retinaStmt != nil {
+		data, err := layer.retryQuery(ctx, layer.retinaStmt, x, y, z)
+		if err == nil && data != nil {
+			data, err = layer.decodeStoredTile(data)
+		}
+		if err != nil || data != nil {
+			if data != nil && watermark != nil {
+				data = watermark.apply(data)
+			}
+			return data, err
+		}
+	}
+	data, err := layer.tile(ctx, x, y, z)
+	if err == nil && data != nil {
+		data, err = layer.decodeStoredTile(data)
+	}
+	if err != nil || data == nil {
+		return nil, err
+	}
+	tile, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	b := tile.Bounds()
+	scaled := image.NewRGBA(image.Rect(0, 0, b.Dx()*scale, b.Dy()*scale))
+	for py := 0; py < scaled.Rect.Dy(); py++ {
+		for px := 0; px < scaled.Rect.Dx(); px++ {
+			scaled.Set(px, py, tile.At(b.Min.X+px/scale, b.Min.Y+py/scale))
+		}
+	}
+	var buf bytes.Buffer
+	if format == "jpeg" {
+		err = jpeg.Encode(&buf, scaled, &jpeg.Options{Quality: 90})
+	} else {
+		err = png.Encode(&buf, scaled)
+	}
+	if err != nil {
+		return nil, err
+	}
+	data = buf.Bytes()
+	if watermark != nil {
+		data = watermark.apply(data)
+	}
+	return data, nil
+}
+
+// decodeStoredTile decodes a tile stored in a content coding, such as a
+// gzip-wrapped PNG, as scaled tiles are sent without one.
+func (layer *Layer) decodeStoredTile(data []byte) ([]byte, error) {
+	_, encoding := layer.contentType(data)
+	if decode := tileDecoders[encoding]; decode != nil {
+		return decode(data)
+	}
+	return data, nil
+}
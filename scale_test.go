@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func TestScaledTiles(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	src.Set(1, 2, color.RGBA{255, 0, 0, 255})
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, src); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	writeTestMBTiles(t, filepath.Join(dir, "plain.mbtiles"), map[string]string{"format": "png"},
+		map[[3]int][]byte{{0, 0, 0}: buf.Bytes()})
+	writeTestMBTiles(t, filepath.Join(dir, "wrapped.mbtiles"), map[string]string{"format": "png"},
+		map[[3]int][]byte{{0, 0, 0}: gzipBytes(t, buf.Bytes())})
+	useDataDir(t, dir)
+	scanLayers()
+
+	for _, name := range []string{"plain", "wrapped"} {
+		resp := serveTest(http.MethodGet, "/"+name+"/0/0/0.png?scale=2")
+		if resp.Code != http.StatusOK {
+			t.Errorf("%s: status %d", name, resp.Code)
+			continue
+		}
+		if got := resp.Header().Get("Content-Encoding"); got != "" {
+			t.Errorf("%s: Content-Encoding %q", name, got)
+		}
+		scaled, err := png.Decode(resp.Body)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if b := scaled.Bounds(); b.Dx() != 8 || b.Dy() != 8 {
+			t.Errorf("%s: scaled to %v", name, b)
+		}
+		if r, _, _, _ := scaled.At(3, 5).RGBA(); r != 0xffff {
+			t.Errorf("%s: pixel not replicated", name)
+		}
+	}
+
+	saved := maxTileScale
+	defer func() { maxTileScale = saved }()
+	maxTileScale = 1
+	if resp := serveTest(http.MethodGet, "/plain/0/0/0.png?scale=2"); resp.Code != http.StatusBadRequest {
+		t.Errorf("scale with scaling disabled: status %d, want 400", resp.Code)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+var selfTest bool
+var requireLayers bool
+
+// runSelfTest reads the tile at the center of every layer at its lowest zoom
+// and reports whether all layers passed. A missing center tile is logged but
+// not counted as a failure, as sparse files may lack it.
+func runSelfTest() bool {
+	ok := true
+	names := make(map[string]*Layer)
+	startingRequests.RLock()
+	for name, layer := range layers {
+		layer.activeRequests.Add(1)
+		names[name] = layer
+	}
+	startingRequests.RUnlock()
+	for name, layer := range names {
+		if !layer.valid {
+			log.Printf("Self-test: layer \"%s\" failed to open", name)
+			ok = false
+			layer.activeRequests.Done()
+			continue
+		}
+		center := layer.center()
+		z := int(center[2])
+		if minZoom, _ := layer.urlZoomRange(); z < minZoom {
+			z = minZoom
+		}
+		x, y := lonToTileX(center[0], z), latToTileRow(center[1], z)
+		var data []byte
+		var err error
+		if stored, storedZ, ok := layer.storedTile(x, y, z); ok {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			data, err = layer.tile(ctx, x, stored, storedZ)
+			cancel()
+		}
+		layer.activeRequests.Done()
+		switch {
+		case err != nil:
+			log.Printf("Self-test: error reading tile z=%d x=%d y=%d of layer \"%s\": %s", z, x, y, name, err)
+			ok = false
+		case data == nil:
+			log.Printf("Self-test: layer \"%s\" has no tile z=%d x=%d y=%d at its center", name, z, x, y)
+		}
+	}
+	if len(names) == 0 {
+		log.Printf("Self-test: no layers found")
+		ok = false
+	}
+	return ok
+}
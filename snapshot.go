@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// localSnapshot makes layers read from a local copy of their file, taken
+// when the layer is opened, so that a producer writing the file in place on a
+// network share can not corrupt reads. A changed file is copied again by the
+// scan that reopens it.
+var localSnapshot bool
+
+// snapshotAttempts is how many times a file that changes while it is copied
+// is copied again before giving up until the next scan.
+const snapshotAttempts = 3
+
+func snapshotLayerFile(filename string) (string, error) {
+	for attempt := 1; ; attempt++ {
+		path, changed, err := copyLayerFile(filename)
+		if err != nil || !changed {
+			return path, err
+		}
+		removeTempFile(path)
+		if attempt == snapshotAttempts {
+			return "", fmt.Errorf("file changed while copying it to a local snapshot")
+		}
+	}
+}
+
+// copyLayerFile copies filename into a temporary file and reports whether the
+// file changed meanwhile, in which case the copy may be torn.
+func copyLayerFile(filename string) (path string, changed bool, err error) {
+	start := time.Now()
+	src, err := os.Open(filename)
+	if err != nil {
+		return "", false, err
+	}
+	defer src.Close()
+	before, err := src.Stat()
+	if err != nil {
+		return "", false, err
+	}
+	tmp, err := createTempFile(filename)
+	if err != nil {
+		return "", false, err
+	}
+	n, err := io.Copy(tmp, src)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		removeTempFile(tmp.Name())
+		return "", false, fmt.Errorf("copying to local snapshot: %s", err)
+	}
+	after, err := os.Stat(filename)
+	if err != nil {
+		removeTempFile(tmp.Name())
+		return "", false, err
+	}
+	changed = !after.ModTime().Equal(before.ModTime()) || after.Size() != before.Size() || n != before.Size()
+	log.Printf("Copied \"%s\" to local snapshot \"%s\" (%d bytes) in %s", filename, tmp.Name(), n,
+		time.Since(start).Round(time.Millisecond))
+	return tmp.Name(), changed, nil
+}
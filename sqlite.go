@@ -0,0 +1,88 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+const sqliteDriver = "sqlite3_mbtiles"
+
+// SQLite tuning applied to every connection, zero keeps SQLite defaults.
+var sqliteCacheSize int
+var sqliteMmapSize int64
+
+// connMaxLifetime recycles pooled connections after this long, so that a
+// connection does not keep reading a file replaced in place. Zero keeps them.
+var connMaxLifetime time.Duration
+
+// analyzeFiles runs ANALYZE on each mbtiles file when it is first opened.
+var analyzeFiles bool
+
+// analyzedFiles holds the paths already analyzed. ANALYZE writes statistics
+// into the file, changing its mtime, and must not rerun when the layer is
+// reopened because of that.
+var analyzedFiles sync.Map
+
+// sqliteDSN returns the data source name of an existing database file. SQLite
+// creates missing files by default, so a pooled connection opened after the
+// file was deleted would leave an empty file behind, which the next scan
+// would load as a broken layer. With mode=rw opening such a connection fails
+// instead. Requests on a removed layer keep using the connections opened
+// before, which read the deleted file until the layer is disposed. Those
+// needing a new one, as the pool is still growing or -conn-max-lifetime
+// retired one, fail with fileDeleted errors.
+func sqliteDSN(filename string) string {
+	escaped := strings.NewReplacer("%", "%25", "?", "%3f", "#", "%23").Replace(filename)
+	return "file:" + escaped + "?mode=rw"
+}
+
+// fileDeleted reports whether err comes from opening a connection to the
+// file of the layer after it was deleted. The layer is removed by the next
+// scan, so such requests are answered like those arriving after it.
+func (layer *Layer) fileDeleted(err error) bool {
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) || sqliteErr.Code != sqlite3.ErrCantOpen {
+		return false
+	}
+	_, err = os.Stat(layer.dataFile)
+	return os.IsNotExist(err)
+}
+
+func init() {
+	sql.Register(sqliteDriver, &sqlite3.SQLiteDriver{ConnectHook: initConnection})
+}
+
+func initConnection(conn *sqlite3.SQLiteConn) error {
+	if sqliteCacheSize != 0 {
+		if _, err := conn.Exec(fmt.Sprintf("PRAGMA cache_size = %d", sqliteCacheSize), nil); err != nil {
+			return err
+		}
+	}
+	if sqliteMmapSize != 0 {
+		if _, err := conn.Exec(fmt.Sprintf("PRAGMA mmap_size = %d", sqliteMmapSize), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// analyze gathers query planner statistics of conn once per filename.
+func analyze(conn *sql.DB, filename string) {
+	if _, done := analyzedFiles.LoadOrStore(filename, true); done {
+		return
+	}
+	start := time.Now()
+	if _, err := conn.Exec("ANALYZE"); err != nil {
+		log.Printf("Error analyzing \"%s\": %s", filename, err)
+		return
+	}
+	log.Printf("Analyzed \"%s\" in %s", filename, time.Since(start).Round(time.Millisecond))
+}
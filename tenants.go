@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// tenants maps URL path prefixes to data directories served in addition to
+// dataDir, e.g. "tenantA" for /tenantA/{layer}/{z}/{x}/{y}. Layers of a
+// tenant are registered as "prefix/name", so that their names, conflicts and
+// -api-keys globs such as "tenantA/*" are scoped to the tenant. A tenant
+// prefix shadows a layer of dataDir with the same name.
+var tenants = make(map[string]string)
+
+// parseTenant adds a "prefix=dir" value of -tenant.
+func parseTenant(value string) error {
+	prefix, dir, ok := strings.Cut(value, "=")
+	if !ok || prefix == "" || dir == "" {
+		return fmt.Errorf("expected prefix=dir")
+	}
+	if sanitizeLayerName(prefix) != prefix {
+		return fmt.Errorf("prefix \"%s\" must only contain letters, digits, '.', '-' and '_'", prefix)
+	}
+	if prefix == "admin" || prefix == "4326" {
+		return fmt.Errorf("prefix \"%s\" is used by other routes", prefix)
+	}
+	if _, ok := tenants[prefix]; ok {
+		return fmt.Errorf("duplicate prefix \"%s\"", prefix)
+	}
+	tenants[prefix] = dir
+	return nil
+}
+
+type layerSource struct {
+	prefix, dir string
+}
+
+// layerSources returns dataDir followed by the tenant directories, sorted by
+// prefix.
+func layerSources() []layerSource {
+	sources := []layerSource{{"", dataDir}}
+	for prefix, dir := range tenants {
+		sources = append(sources, layerSource{prefix, dir})
+	}
+	sort.Slice(sources[1:], func(i, j int) bool { return sources[i+1].prefix < sources[j+1].prefix })
+	return sources
+}
+
+// layerPrefix returns the tenant prefix of a layer name, or "" for layers of
+// dataDir.
+func layerPrefix(name string) string {
+	prefix, _, ok := strings.Cut(name, "/")
+	if !ok {
+		return ""
+	}
+	return prefix
+}
+
+// layerPathFields splits a URL path like strings.Split, but keeps the
+// segments of a layer name containing slashes together as the layer field.
+// The longest registered layer name at the start of the path wins, so that a
+// name may be a prefix of another. Otherwise a tenant prefix and the
+// following segment are kept together.
+func layerPathFields(path string) []string {
+	fields := strings.Split(path, "/")
+	n := layerNameSegments(fields)
+	if n == 1 && len(fields) > 2 && tenants[fields[1]] != "" {
+		n = 2
+	}
+	if n > 1 {
+		fields = append([]string{"", strings.Join(fields[1:1+n], "/")}, fields[1+n:]...)
+	}
+	return fields
+}
+
+// maxNameSegments is the largest number of slash-separated segments of a
+// registered layer name, so that looking up the layer name of a path takes at
+// most that many map lookups. It only grows. It is guarded by
+// startingRequests.
+var maxNameSegments = 1
+
+func registerNameSegments(name string) {
+	if n := strings.Count(name, "/") + 1; n > maxNameSegments {
+		maxNameSegments = n
+	}
+}
+
+// layerNameSegments returns the number of segments of fields, after the
+// leading empty one, forming the longest open or closed layer name with
+// slashes, or 1. The only such names are the two-segment "prefix/name" of
+// tenant layers: sanitizeLayerName replaces slashes of file names, and data
+// directories are not scanned recursively.
+func layerNameSegments(fields []string) int {
+	startingRequests.RLock()
+	defer startingRequests.RUnlock()
+	for n := maxNameSegments; n > 1; n-- {
+		if n >= len(fields) {
+			continue
+		}
+		name := strings.Join(fields[1:1+n], "/")
+		if _, ok := layers[name]; ok {
+			return n
+		}
+		if _, ok := closedLayers[name]; ok {
+			return n
+		}
+	}
+	return 1
+}
+
+// layerURLPath escapes a layer name for use in URLs, keeping the slash after
+// a tenant prefix.
+func layerURLPath(name string) string {
+	if prefix := layerPrefix(name); prefix != "" {
+		return url.PathEscape(prefix) + "/" + url.PathEscape(strings.TrimPrefix(name, prefix+"/"))
+	}
+	return url.PathEscape(name)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLayerPathFields(t *testing.T) {
+	savedLayers, savedTenants, savedSegments := layers, tenants, maxNameSegments
+	defer func() { layers, tenants, maxNameSegments = savedLayers, savedTenants, savedSegments }()
+	layers, tenants, maxNameSegments = make(map[string]*Layer), map[string]string{"t": "tenant"}, 1
+	// "t/a/b" can not come from a scan, but names nested deeper than a
+	// tenant prefix are matched all the same.
+	for _, name := range []string{"x", "t/a", "t/a/b"} {
+		layers[name] = &Layer{}
+		registerNameSegments(name)
+	}
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{"/x/1/2/3.png", []string{"", "x", "1", "2", "3.png"}},
+		{"/t/a/1/2/3.png", []string{"", "t/a", "1", "2", "3.png"}},
+		// "t/a" is a prefix of "t/a/b", and the longer name wins.
+		{"/t/a/b/1/2/3.png", []string{"", "t/a/b", "1", "2", "3.png"}},
+		{"/t/a/b.json", []string{"", "t/a", "b.json"}},
+		{"/t/a.json", []string{"", "t/a.json"}},
+		// Unknown layers of a tenant still get the tenant prefix.
+		{"/t/c/1/2/3.png", []string{"", "t/c", "1", "2", "3.png"}},
+		{"/y/1/2/3.png", []string{"", "y", "1", "2", "3.png"}},
+		{"/", []string{"", ""}},
+	}
+	for _, tt := range tests {
+		if got := layerPathFields(tt.path); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("layerPathFields(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type TileJSON struct {
+	TileJSON     string          `json:"tilejson"`
+	ID           string          `json:"id"`
+	Name         string          `json:"name"`
+	Description  string          `json:"description,omitempty"`
+	Attribution  string          `json:"attribution,omitempty"`
+	Format       string          `json:"format,omitempty"`
+	Scheme       string          `json:"scheme"`
+	Tiles        []string        `json:"tiles"`
+	Grids        []string        `json:"grids,omitempty"`
+	MinZoom      int             `json:"minzoom"`
+	MaxZoom      int             `json:"maxzoom"`
+	Bounds       [4]float64      `json:"bounds"`
+	Center       [3]float64      `json:"center"`
+	VectorLayers json.RawMessage `json:"vector_layers,omitempty"`
+}
+
+// parseVectorLayers extracts the vector_layers array from the mbtiles "json"
+// metadata value of vector layers.
+func parseVectorLayers(value string) (json.RawMessage, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var doc struct {
+		VectorLayers []json.RawMessage `json:"vector_layers"`
+	}
+	if err := json.Unmarshal([]byte(value), &doc); err != nil {
+		return nil, err
+	}
+	if doc.VectorLayers == nil {
+		return nil, nil
+	}
+	return json.Marshal(doc.VectorLayers)
+}
+
+// baseURL returns the scheme and host clients used to reach the server,
+// honoring headers set by reverse proxies.
+func baseURL(req *http.Request) string {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	if proto := req.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = strings.TrimSpace(strings.Split(proto, ",")[0])
+	}
+	host := req.Host
+	if forwarded := req.Header.Get("X-Forwarded-Host"); forwarded != "" {
+		host = strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	}
+	return scheme + "://" + host
+}
+
+// center is the initial view of the layer as [lon, lat, zoom]: the viewCenter
+// and viewZoom of the config where set, otherwise those of metadataCenter.
+func (layer *Layer) center() [3]float64 {
+	c := layer.metadataCenter()
+	if v := layer.config.ViewCenter; v != nil {
+		c[0], c[1] = v[0], v[1]
+	}
+	if z := layer.config.ViewZoom; z != nil {
+		c[2] = *z
+	}
+	return c
+}
+
+// metadataCenter is the center metadata value, with its zoom shifted like the
+// zoom range, or the middle of the bounds at the lowest zoom.
+func (layer *Layer) metadataCenter() [3]float64 {
+	parts := strings.Split(layer.metadata["center"], ",")
+	if len(parts) == 3 {
+		var c [3]float64
+		var err error
+		for i, part := range parts {
+			if c[i], err = strconv.ParseFloat(strings.TrimSpace(part), 64); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			c[2] -= float64(layer.config.ZoomOffset)
+			return c
+		}
+	}
+	b := layer.bounds()
+	minZoom, _ := layer.urlZoomRange()
+	return [3]float64{(b.minLon + b.maxLon) / 2, (b.minLat + b.maxLat) / 2, float64(minZoom)}
+}
+
+// tileScheme is the row numbering of tile URLs.
+const tileScheme = "tms"
+
+// tileURLExtension makes advertised tile URLs end in the extension of the
+// layer format.
+var tileURLExtension bool
+
+// coordTemplate returns the coordinate segments of URL templates in
+// coordOrder.
+func coordTemplate() string {
+	if coordOrder == "zyx" {
+		return "{z}/{y}/{x}"
+	}
+	return "{z}/{x}/{y}"
+}
+
+// tileURL returns the path template of tile URLs of the layer, as advertised
+// in TileJSON and used by the viewer.
+func (layer *Layer) tileURL(name string) string {
+	path := "/" + layerURLPath(name) + "/" + coordTemplate()
+	if tileURLExtension && layer.metadata["format"] != "" {
+		path += "." + layer.extension()
+	}
+	return path
+}
+
+func (layer *Layer) tileJSON(name, base string) TileJSON {
+	minZoom, maxZoom := layer.urlZoomRange()
+	b := layer.bounds()
+	title := layer.metadata["name"]
+	if title == "" {
+		title = name
+	}
+	var grids []string
+	if path := layer.gridURL(name); path != "" {
+		grids = []string{base + path}
+	}
+	return TileJSON{
+		TileJSON:     "2.2.0",
+		ID:           name,
+		Name:         title,
+		Description:  layer.metadata["description"],
+		Attribution:  layer.metadata["attribution"],
+		Format:       layer.metadata["format"],
+		Scheme:       tileScheme,
+		Tiles:        []string{base + layer.tileURL(name)},
+		Grids:        grids,
+		MinZoom:      minZoom,
+		MaxZoom:      maxZoom,
+		Bounds:       [4]float64{b.minLon, b.minLat, b.maxLon, b.maxLat},
+		Center:       layer.center(),
+		VectorLayers: layer.vectorLayers,
+	}
+}
+
+func sortedLayerNames() []string {
+	startingRequests.RLock()
+	defer startingRequests.RUnlock()
+	names := make([]string, 0, len(layers))
+	for name, layer := range layers {
+		if layer.valid {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func writeJSON(resp http.ResponseWriter, req *http.Request, v interface{}) {
+	allowOrigin(resp, req)
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(v)
+}
+
+// jsonpCallback matches callback names that are plain JavaScript identifiers,
+// possibly dotted, so that the callback parameter can not inject code.
+var jsonpCallback = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$]*(\.[A-Za-z_$][A-Za-z0-9_$]*)*$`)
+
+// writeJSONP is writeJSON for endpoints used by legacy clients, which wraps
+// the document in a call of the callback query parameter if it is given.
+func writeJSONP(resp http.ResponseWriter, req *http.Request, v interface{}) {
+	callback := req.URL.Query().Get("callback")
+	if callback == "" {
+		writeJSON(resp, req, v)
+		return
+	}
+	if len(callback) > 128 || !jsonpCallback.MatchString(callback) {
+		http.Error(resp, "invalid callback", http.StatusBadRequest)
+		return
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		http.Error(resp, "", 500)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/javascript")
+	resp.Header().Set("X-Content-Type-Options", "nosniff")
+	// The leading comment keeps the response from being read as a Flash file.
+	resp.Write([]byte("/**/" + callback + "("))
+	resp.Write(data)
+	resp.Write([]byte(");\n"))
+}
+
+// layerTileJSONs returns TileJSON of the layers the request may access.
+func layerTileJSONs(req *http.Request, base string) []TileJSON {
+	names := filterLayerNames(sortedLayerNames(), layerFilter(req))
+	docs := make([]TileJSON, 0, len(names))
+	startingRequests.RLock()
+	defer startingRequests.RUnlock()
+	for _, name := range names {
+		if layer, ok := layers[name]; ok {
+			docs = append(docs, layer.tileJSON(name, base))
+		}
+	}
+	return docs
+}
+
+func layersResponse(resp http.ResponseWriter, req *http.Request) {
+	writeJSONP(resp, req, layerTileJSONs(req, baseURL(req)))
+}
+
+type CatalogEntry struct {
+	TileJSON
+	URL string `json:"url"`
+}
+
+type Catalog struct {
+	Layers []CatalogEntry `json:"layers"`
+}
+
+// catalogResponse lists TileJSON of the layers the request may access along
+// with the URL of each layer's own TileJSON document.
+func catalogResponse(resp http.ResponseWriter, req *http.Request) {
+	base := baseURL(req)
+	catalog := Catalog{Layers: make([]CatalogEntry, 0)}
+	for _, doc := range layerTileJSONs(req, base) {
+		catalog.Layers = append(catalog.Layers, CatalogEntry{doc, base + "/" + layerURLPath(doc.ID) + ".json"})
+	}
+	writeJSON(resp, req, catalog)
+}
+
+func tileJSONResponse(resp http.ResponseWriter, req *http.Request) {
+	name := strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, "/"), ".json")
+	if !checkLayerAccess(resp, req, name) {
+		return
+	}
+	startingRequests.RLock()
+	layer, ok := layers[name]
+	startingRequests.RUnlock()
+	if !ok || !layer.valid {
+		http.NotFound(resp, req)
+		return
+	}
+	writeJSONP(resp, req, layer.tileJSON(name, baseURL(req)))
+}
+
+// metadataResponse serves every row of the layer's metadata table, including
+// keys that TileJSON leaves out. The table is read when the layer is opened.
+func metadataResponse(resp http.ResponseWriter, req *http.Request) {
+	name := strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, "/"), "/metadata.json")
+	layer := acquireRequestLayer(resp, req, name)
+	if layer == nil {
+		return
+	}
+	defer layer.activeRequests.Done()
+	if !layer.valid {
+		http.NotFound(resp, req)
+		return
+	}
+	writeJSON(resp, req, layer.metadata)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testVectorJSON is the "json" metadata value of an OpenMapTiles-like file,
+// with keys besides vector_layers that TileJSON leaves out.
+const testVectorJSON = `{
+	"vector_layers": [
+		{"id": "water", "description": "", "minzoom": 0, "maxzoom": 14, "fields": {"class": "String", "intermittent": "Number"}},
+		{"id": "transportation_name", "minzoom": 8, "maxzoom": 14, "fields": {"name": "String", "name:latin": "String", "ref": "String"}}
+	],
+	"tilestats": {"layerCount": 2, "layers": [{"layer": "water", "count": 1024, "geometry": "Polygon"}]}
+}`
+
+func TestParseVectorLayers(t *testing.T) {
+	tests := []struct {
+		name, value string
+		want        string
+		wantErr     bool
+	}{
+		{"empty", "", "", false},
+		{"without vector_layers", `{"tilestats": {}}`, "", false},
+		{"empty vector_layers", `{"vector_layers": []}`, "[]", false},
+		{"malformed", `{"vector_layers": [`, "", true},
+		{"not an object", `[1, 2]`, "", true},
+	}
+	for _, tt := range tests {
+		got, err := parseVectorLayers(tt.value)
+		if (err != nil) != tt.wantErr || string(got) != tt.want {
+			t.Errorf("%s: parseVectorLayers = %s, %v, want %s, error %v", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestTileJSONVectorLayers(t *testing.T) {
+	dir := t.TempDir()
+	writeTestMBTiles(t, filepath.Join(dir, "v.mbtiles"), map[string]string{"format": "pbf", "json": testVectorJSON}, nil)
+	writeTestMBTiles(t, filepath.Join(dir, "bad.mbtiles"), map[string]string{"format": "pbf", "json": "{not json"}, nil)
+	useDataDir(t, dir)
+	scanLayers()
+
+	resp := serveTest(http.MethodGet, "/v.json")
+	var doc struct {
+		VectorLayers []map[string]interface{} `json:"vector_layers"`
+		Tilestats    interface{}              `json:"tilestats"`
+	}
+	if err := json.Unmarshal(resp.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("invalid TileJSON %q: %s", resp.Body.Bytes(), err)
+	}
+	var ids []interface{}
+	for _, layer := range doc.VectorLayers {
+		ids = append(ids, layer["id"])
+	}
+	if want := []interface{}{"water", "transportation_name"}; !reflect.DeepEqual(ids, want) {
+		t.Fatalf("vector_layers ids %v, want %v", ids, want)
+	}
+	if fields, _ := doc.VectorLayers[1]["fields"].(map[string]interface{}); fields["name:latin"] != "String" {
+		t.Errorf("fields of transportation_name not passed on: %v", doc.VectorLayers[1])
+	}
+	if doc.Tilestats != nil {
+		t.Errorf("tilestats included in TileJSON")
+	}
+
+	// Invalid json metadata is only warned about.
+	resp = serveTest(http.MethodGet, "/bad.json")
+	if resp.Code != http.StatusOK {
+		t.Fatalf("layer with invalid json metadata: status %d", resp.Code)
+	}
+	var bad map[string]interface{}
+	if err := json.Unmarshal(resp.Body.Bytes(), &bad); err != nil || bad["vector_layers"] != nil {
+		t.Errorf("layer with invalid json metadata: TileJSON %q", resp.Body.Bytes())
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+)
+
+var tlsCert, tlsKey string
+
+// httpRedirectPort, when set with TLS enabled, is a plain HTTP port that
+// redirects every request to the HTTPS server.
+var httpRedirectPort int
+
+// http2Enabled offers HTTP/2 by ALPN on TLS connections. Plain HTTP is always
+// served as HTTP/1.1. -idle-timeout closes idle HTTP/2 connections as it does
+// HTTP/1.1 ones, and with -keepalive=false an HTTP/2 connection is closed
+// after its open streams complete, so multiplexing is lost as well.
+var http2Enabled = true
+
+// redirectToHTTPS returns a handler sending clients to the same path and
+// query on the HTTPS port.
+func redirectToHTTPS(httpsPort int) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if httpsPort != 443 {
+			host = net.JoinHostPort(host, fmt.Sprint(httpsPort))
+		} else if net.ParseIP(host) != nil && net.ParseIP(host).To4() == nil {
+			host = "[" + host + "]"
+		}
+		http.Redirect(resp, req, "https://"+host+req.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// serve runs server, over TLS if configured, along with the HTTP redirect
+// listener. The redirect listener is closed when the main server stops.
+func serve(server *http.Server, host string, port int) error {
+	if tlsCert == "" {
+		return server.ListenAndServe()
+	}
+	if httpRedirectPort != 0 {
+		redirect := &http.Server{
+			Addr:    fmt.Sprintf("%s:%d", host, httpRedirectPort),
+			Handler: redirectToHTTPS(port),
+		}
+		defer redirect.Close()
+		go func() {
+			if err := redirect.ListenAndServe(); err != http.ErrServerClosed {
+				log.Fatalf("HTTP redirect listener failed: %s", err)
+			}
+		}()
+	}
+	if !http2Enabled {
+		// A non-nil empty map keeps net/http from configuring HTTP/2, so only
+		// "http/1.1" is offered by ALPN.
+		server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+	return server.ListenAndServeTLS(tlsCert, tlsKey)
+}
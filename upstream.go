@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// upstream is a tile URL template consulted when a tile is missing locally.
+// It may reference {layer}, {z}, {x}, {y} for the XYZ row and {-y} for the
+// TMS row.
+var upstream string
+var upstreamTimeout = 10 * time.Second
+
+// upstreamWriteBack stores tiles fetched from upstream in the mbtiles file of
+// the layer. Each write changes the file, so the layer is reopened on the
+// next scan. It can not be combined with -local-snapshot, which would write
+// to the copy, nor with -build-indexes, which would rebuild the presence
+// index on each reopen.
+var upstreamWriteBack bool
+
+var upstreamClient = &http.Client{}
+
+func upstreamURL(name string, x, y, z int) string {
+	return strings.NewReplacer(
+		"{layer}", url.PathEscape(name),
+		"{z}", strconv.Itoa(z),
+		"{x}", strconv.Itoa(x),
+		"{y}", strconv.Itoa((1<<uint(z))-1-y),
+		"{-y}", strconv.Itoa(y),
+	).Replace(upstream)
+}
+
+// fetchUpstream reads the tile at the TMS coordinates of the tile URL from the
+// upstream server. It returns nil data if upstream does not have the tile
+// either. Only the body is used: upstream headers are not passed on to the
+// client.
+func (layer *Layer) fetchUpstream(ctx context.Context, x, y, z int) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, upstreamTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, upstreamURL(layer.name, x, y, z), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := upstreamClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusNoContent:
+		return nil, nil
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("upstream returned %s", resp.Status)
+	}
+	body := io.Reader(resp.Body)
+	if maxTileBytes > 0 {
+		body = io.LimitReader(resp.Body, maxTileBytes+1)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	if maxTileBytes > 0 && int64(len(data)) > maxTileBytes {
+		return nil, errTileTooLarge
+	}
+	if layer.writesBack() {
+		if stored, storedZ, ok := layer.storedTile(x, y, z); ok {
+			if err := layer.storeTile(x, stored, storedZ, data); err != nil {
+				log.Printf("Error storing upstream tile in \"%s\": %s", layer.path, err)
+			}
+		}
+	}
+	return data, nil
+}
+
+// writesBack reports whether tiles fetched from upstream are stored in the
+// file of the layer. Decompressed layers are read from a temporary copy,
+// which is thrown away when the layer is reopened, so they are not written.
+func (layer *Layer) writesBack() bool {
+	return upstreamWriteBack && layer.pmtiles == nil && layer.tempFile == ""
+}
+
+func (layer *Layer) storeTile(x, y, z int, data []byte) error {
+	c := layer.config.Columns
+	_, err := layer.conn.Exec(fmt.Sprintf("INSERT OR REPLACE INTO %s (%s, %s, %s, %s) VALUES (?, ?, ?, ?)",
+		c.from(), quoteIdent(c.Zoom), quoteIdent(c.Column), quoteIdent(c.Row), quoteIdent(c.Data)), z, x, y, data)
+	return err
+}
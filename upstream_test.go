@@ -0,0 +1,70 @@
+package main
+
+import (
+	"compress/gzip"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestUpstreamWriteBack checks that tiles fetched from upstream are stored in
+// plain mbtiles files but not in the temporary copy of compressed ones.
+func TestUpstreamWriteBack(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write(testPNG)
+	}))
+	defer server.Close()
+	savedUpstream, savedWriteBack := upstream, upstreamWriteBack
+	defer func() { upstream, upstreamWriteBack = savedUpstream, savedWriteBack }()
+	upstream, upstreamWriteBack = server.URL+"/{layer}/{z}/{x}/{y}.png", true
+
+	dir := t.TempDir()
+	plain := filepath.Join(dir, "plain.mbtiles")
+	writeTestMBTiles(t, plain, map[string]string{"format": "png", "minzoom": "0", "maxzoom": "1"},
+		map[[3]int][]byte{{0, 0, 0}: testPNG})
+	src := filepath.Join(t.TempDir(), "src.mbtiles")
+	writeTestMBTiles(t, src, map[string]string{"format": "png", "minzoom": "0", "maxzoom": "1"},
+		map[[3]int][]byte{{0, 0, 0}: testPNG})
+	data, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(filepath.Join(dir, "packed.mbtiles.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz := gzip.NewWriter(f)
+	gz.Write(data)
+	gz.Close()
+	f.Close()
+	useDataDir(t, dir)
+	scanLayers()
+
+	for name, want := range map[string]bool{"plain": true, "packed": false} {
+		startingRequests.RLock()
+		layer := layers[name]
+		startingRequests.RUnlock()
+		if layer == nil {
+			t.Fatalf("layer %s not loaded", name)
+		}
+		if got := layer.writesBack(); got != want {
+			t.Errorf("%s: writesBack() = %v, want %v", name, got, want)
+		}
+		if resp := serveTest(http.MethodGet, "/"+name+"/1/1/1.png"); resp.Code != http.StatusOK {
+			t.Errorf("%s: tile from upstream: status %d", name, resp.Code)
+		}
+	}
+
+	db, err := sql.Open("sqlite3", plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var n int
+	if err := db.QueryRow("SELECT count(*) FROM tiles WHERE zoom_level = 1 AND tile_column = 1 AND tile_row = 1").Scan(&n); err != nil || n != 1 {
+		t.Errorf("upstream tile not stored in plain file: %d rows, %v", n, err)
+	}
+}
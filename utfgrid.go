@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// UTFGrid interaction data is read from the "grids" and optional "grid_data"
+// tables of the MBTiles 1.1 spec and served at /{layer}/{z}/{x}/{y}.grid.json
+// with the grid_data keys merged into the "data" field of the grid.
+const gridSuffix = ".grid.json"
+
+func (layer *Layer) prepareGridQueries() {
+	grids := TileColumns{Table: "grids", Data: "grid"}
+	grids.setDefaults("")
+	var err error
+	if layer.gridStmt, err = layer.prepareTileQuery(grids); err != nil {
+		layer.gridStmt = nil
+		return
+	}
+	data := TileColumns{Table: "grid_data", Data: "key_json"}
+	data.setDefaults("")
+	existing, err := tableColumns(layer.conn, data.Table)
+	if err != nil || data.check(existing) != nil || !existing["key_name"] {
+		return
+	}
+	layer.gridDataStmt, _ = layer.conn.Prepare("SELECT key_name, key_json FROM " + data.from() + " WHERE " + data.where())
+}
+
+// gridURL returns the path template of UTFGrid URLs of the layer, or "" if it
+// has no grids.
+func (layer *Layer) gridURL(name string) string {
+	if layer.gridStmt == nil {
+		return ""
+	}
+	return "/" + layerURLPath(name) + "/" + coordTemplate() + gridSuffix
+}
+
+// utfGrid returns the UTFGrid of a tile with its data, or nil if there is none.
+func (layer *Layer) utfGrid(ctx context.Context, x, y, z int) (map[string]json.RawMessage, error) {
+	blob, err := layer.retryQuery(ctx, layer.gridStmt, x, y, z)
+	if err != nil || blob == nil {
+		return nil, err
+	}
+	var r io.Reader
+	if bytes.HasPrefix(blob, []byte{0x1f, 0x8b}) {
+		blob, err = gunzip(blob)
+		r = bytes.NewReader(blob)
+	} else {
+		r, err = zlib.NewReader(bytes.NewReader(blob))
+	}
+	if err != nil {
+		return nil, err
+	}
+	var grid map[string]json.RawMessage
+	if err := json.NewDecoder(r).Decode(&grid); err != nil {
+		return nil, err
+	}
+	if layer.gridDataStmt == nil {
+		return grid, nil
+	}
+	rows, err := layer.gridDataStmt.QueryContext(ctx, z, x, y)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	data := make(map[string]json.RawMessage)
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, err
+		}
+		if json.Valid([]byte(value)) {
+			data[key] = json.RawMessage(value)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if grid["data"], err = json.Marshal(data); err != nil {
+			return nil, err
+		}
+	}
+	return grid, nil
+}
+
+func gridResponse(resp http.ResponseWriter, req *http.Request) {
+	urlFields := layerPathFields(strings.TrimSuffix(req.URL.Path, gridSuffix))
+	if len(urlFields) != 5 {
+		notFoundResponse(resp, req)
+		return
+	}
+	name := urlFields[1]
+	layer := acquireRequestLayer(resp, req, name)
+	if layer == nil {
+		return
+	}
+	defer layer.activeRequests.Done()
+	if !layer.valid || layer.gridStmt == nil {
+		http.NotFound(resp, req)
+		return
+	}
+	z, x, y, err := parseTileCoords(urlFields[2], urlFields[3], urlFields[4])
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+	stored, storedZ, ok := layer.storedTile(x, y, z)
+	if !ok {
+		http.NotFound(resp, req)
+		return
+	}
+	grid, err := layer.utfGrid(req.Context(), x, stored, storedZ)
+	if err != nil {
+		logTileError("Error getting grid", name, z, x, y, err)
+		tileErrorResponse(resp, err)
+		return
+	}
+	if grid == nil {
+		http.NotFound(resp, req)
+		return
+	}
+	writeJSONP(resp, req, grid)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"os"
+)
+
+const watermarkMargin = 4
+
+type Watermark struct {
+	img      image.Image
+	position string
+}
+
+func loadWatermark(filename, position string) (*Watermark, error) {
+	switch position {
+	case "top-left", "top-right", "bottom-left", "bottom-right":
+	default:
+		return nil, fmt.Errorf("unknown watermark position \"%s\"", position)
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, err
+	}
+	return &Watermark{img: img, position: position}, nil
+}
+
+func (wm *Watermark) offset(tile image.Rectangle) image.Point {
+	size := wm.img.Bounds().Size()
+	x, y := tile.Min.X+watermarkMargin, tile.Min.Y+watermarkMargin
+	switch wm.position {
+	case "top-right":
+		x = tile.Max.X - size.X - watermarkMargin
+	case "bottom-left":
+		y = tile.Max.Y - size.Y - watermarkMargin
+	case "bottom-right":
+		x = tile.Max.X - size.X - watermarkMargin
+		y = tile.Max.Y - size.Y - watermarkMargin
+	}
+	return image.Pt(x, y)
+}
+
+// apply returns data with the watermark composited over it. Tiles that are
+// not PNG or JPEG, or fail to decode, are returned unchanged.
+func (wm *Watermark) apply(data []byte) []byte {
+	tile, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil || (format != "png" && format != "jpeg") {
+		return data
+	}
+	canvas := image.NewRGBA(tile.Bounds())
+	draw.Draw(canvas, canvas.Bounds(), tile, tile.Bounds().Min, draw.Src)
+	dst := image.Rectangle{wm.offset(canvas.Bounds()), wm.offset(canvas.Bounds()).Add(wm.img.Bounds().Size())}
+	draw.Draw(canvas, dst, wm.img, wm.img.Bounds().Min, draw.Over)
+	var buf bytes.Buffer
+	if format == "jpeg" {
+		err = jpeg.Encode(&buf, canvas, &jpeg.Options{Quality: 90})
+	} else {
+		err = png.Encode(&buf, canvas)
+	}
+	if err != nil {
+		return data
+	}
+	return buf.Bytes()
+}